@@ -0,0 +1,130 @@
+package export
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "math"
+
+//
+// Arc fitting
+//
+// Used for emitting G2/G3 arcs from the linearized position stack
+//
+// Notes:
+//   Only XY arcs at constant Z are reconstructed
+//
+
+// Minimum number of linear moves to replace with an arc
+const minArcMoves = 3
+
+// An XY arc fitted to a run of linear moves
+type FittedArc struct {
+	Start, End int     // Position indices of the first and last point of the run
+	CX, CY     float64 // Center
+	Clockwise  bool
+}
+
+// Finds runs of linear moves at constant Z and unchanged state that lie within tolerance of an
+// arc. Both the points and the original segments must be within tolerance of the arc, and runs
+// that are within tolerance of a straight line are left alone. Arcs are not extended beyond a
+// total turn of maxSpan radians.
+func FitArcs(m *vm.Machine, tolerance, maxSpan float64) []FittedArc {
+	var arcs []FittedArc
+	p := m.Positions
+	for s := 0; s+minArcMoves < len(p); {
+		var best FittedArc
+		found := false
+		for e := s + 1; e < len(p); e++ {
+			if p[e].State.MoveMode != vm.MoveModeLinear || p[e].State != p[s+1].State || p[e].Z != p[s].Z {
+				break
+			}
+			if e-s < minArcMoves || straight(p[s:e+1], tolerance) {
+				continue
+			}
+			a, ok := fitArc(p[s:e+1], tolerance, maxSpan)
+			if !ok {
+				break
+			}
+			a.Start, a.End = s, e
+			best, found = a, true
+		}
+		if found {
+			arcs = append(arcs, best)
+			s = best.End
+		} else {
+			s++
+		}
+	}
+	return arcs
+}
+
+// Tests if all points are within tolerance of the line through the first and last point.
+// Such runs are extended rather than fitted, as the arc would be no better than the line.
+func straight(pts []vm.Position, tolerance float64) bool {
+	a, c := pts[0], pts[len(pts)-1]
+	chord := math.Hypot(c.X-a.X, c.Y-a.Y)
+	for _, pt := range pts {
+		dist := math.Abs((c.X-a.X)*(a.Y-pt.Y) - (a.X-pt.X)*(c.Y-a.Y))
+		if chord > 0 {
+			dist /= chord
+		} else {
+			dist = math.Hypot(pt.X-a.X, pt.Y-a.Y)
+		}
+		if dist > tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// Fits an arc through the first, middle and last point, and verifies the rest against it.
+func fitArc(pts []vm.Position, tolerance, maxSpan float64) (FittedArc, bool) {
+	a, b, c := pts[0], pts[len(pts)/2], pts[len(pts)-1]
+	d := 2 * (a.X*(b.Y-c.Y) + b.X*(c.Y-a.Y) + c.X*(a.Y-b.Y))
+	if d == 0 {
+		return FittedArc{}, false
+	}
+	a2, b2, c2 := a.X*a.X+a.Y*a.Y, b.X*b.X+b.Y*b.Y, c.X*c.X+c.Y*c.Y
+	cx := (a2*(b.Y-c.Y) + b2*(c.Y-a.Y) + c2*(a.Y-b.Y)) / d
+	cy := (a2*(c.X-b.X) + b2*(a.X-c.X) + c2*(b.X-a.X)) / d
+	r := math.Hypot(a.X-cx, a.Y-cy)
+
+	sweep := 0.0
+	clockwise := false
+	for idx, pt := range pts {
+		if math.Abs(math.Hypot(pt.X-cx, pt.Y-cy)-r) > tolerance {
+			return FittedArc{}, false
+		}
+		if idx == 0 {
+			continue
+		}
+
+		// The segment must turn in the same direction as the others
+		prev := pts[idx-1]
+		cross := (prev.X-cx)*(pt.Y-cy) - (prev.Y-cy)*(pt.X-cx)
+		dot := (prev.X-cx)*(pt.X-cx) + (prev.Y-cy)*(pt.Y-cy)
+		if cross == 0 {
+			return FittedArc{}, false
+		}
+		if idx == 1 {
+			clockwise = cross < 0
+		} else if clockwise != (cross < 0) {
+			return FittedArc{}, false
+		}
+		sweep += math.Abs(math.Atan2(cross, dot))
+		if sweep > maxSpan {
+			return FittedArc{}, false
+		}
+
+		// The segment must not deviate from the arc by more than tolerance
+		half := math.Hypot(pt.X-prev.X, pt.Y-prev.Y) / 2
+		if half > r || r-math.Sqrt(r*r-half*half) > tolerance {
+			return FittedArc{}, false
+		}
+	}
+
+	// A full circle cannot be expressed by its end points
+	if sweep >= 2*math.Pi {
+		return FittedArc{}, false
+	}
+
+	return FittedArc{CX: cx, CY: cy, Clockwise: clockwise}, true
+}
@@ -0,0 +1,102 @@
+package export
+
+import "fmt"
+import "math"
+import "strings"
+import "testing"
+import "github.com/kennylevinsen/gocnc/gcode"
+import "github.com/kennylevinsen/gocnc/vm"
+
+// Parses and processes src on a fresh machine
+func process(t *testing.T, src string) *vm.Machine {
+	doc, err := gcode.Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m vm.Machine
+	m.Init()
+	if err := m.Process(doc); err != nil {
+		t.Fatal(err)
+	}
+	return &m
+}
+
+// Program of linear moves along an arc around the origin, from angle a1 to a2
+func linearArc(radius, a1, a2 float64, segments int) string {
+	src := fmt.Sprintf("G21G90\nG0X%.6fY%.6f\nG1F100", radius*math.Cos(a1), radius*math.Sin(a1))
+	for i := 1; i <= segments; i++ {
+		a := a1 + (a2-a1)*float64(i)/float64(segments)
+		src += fmt.Sprintf("X%.6fY%.6f\n", radius*math.Cos(a), radius*math.Sin(a))
+	}
+	return src
+}
+
+func TestFitArcs(t *testing.T) {
+	m := process(t, linearArc(10, 0, math.Pi/2, 20))
+	arcs := FitArcs(m, 0.01, math.Pi)
+	if len(arcs) != 1 {
+		t.Fatalf("expected 1 arc, got %d", len(arcs))
+	}
+	a := arcs[0]
+	if math.Hypot(a.CX, a.CY) > 0.01 || a.Clockwise {
+		t.Errorf("unexpected arc: %+v", a)
+	}
+	if a.Start != 1 || a.End != 21 {
+		t.Errorf("expected the arc to span positions 1-21, got %d-%d", a.Start, a.End)
+	}
+
+	// Nearly straight runs are left alone
+	m = process(t, linearArc(100000, 0, 0.0002, 20))
+	if arcs := FitArcs(m, 0.01, math.Pi); len(arcs) != 0 {
+		t.Errorf("expected no arcs for a nearly straight run, got %+v", arcs)
+	}
+}
+
+func TestFitArcsMaxSpan(t *testing.T) {
+	m := process(t, linearArc(10, 0, math.Pi/2, 20))
+	arcs := FitArcs(m, 0.01, math.Pi/8)
+	if len(arcs) < 4 {
+		t.Fatalf("expected the quarter circle to be split in at least 4 arcs, got %d", len(arcs))
+	}
+	for _, a := range arcs {
+		s, e := m.Positions[a.Start], m.Positions[a.End]
+		turn := math.Atan2(e.Y-a.CY, e.X-a.CX) - math.Atan2(s.Y-a.CY, s.X-a.CX)
+		if turn > math.Pi/8+1e-6 {
+			t.Errorf("arc %d-%d turns by %f, exceeding the maximum span", a.Start, a.End, turn)
+		}
+	}
+}
+
+func TestHandleAllPositionsEmitArcs(t *testing.T) {
+	m := process(t, linearArc(10, 0, 2*math.Pi, 200))
+	g := &StringCodeGenerator{Precision: 5}
+	g.Init()
+	if err := HandleAllPositionsEmitArcs(m, 0.01, math.Pi, g); err != nil {
+		t.Fatal(err)
+	}
+	src := g.Retrieve()
+
+	var arcs, lines int
+	for _, line := range strings.Split(src, "\n") {
+		switch {
+		case strings.HasPrefix(line, "G2") || strings.HasPrefix(line, "G3"):
+			arcs++
+		case strings.Contains(line, "X") || strings.Contains(line, "Y"):
+			lines++
+		}
+	}
+	if arcs == 0 || lines > 5 {
+		t.Errorf("expected the circle to be emitted as arcs, got %d arcs and %d other moves:\n%s", arcs, lines, src)
+	}
+
+	// The re-processed path stays on the circle, and ends where it started
+	r := process(t, src)
+	for idx, pos := range r.Positions[1:] {
+		if pos.State.MoveMode != vm.MoveModeNone && math.Abs(math.Hypot(pos.X, pos.Y)-10) > 0.01 {
+			t.Errorf("position %d: X%f Y%f is off the circle", idx+1, pos.X, pos.Y)
+		}
+	}
+	if end := r.Positions[len(r.Positions)-1]; math.Abs(end.X-10) > 1e-4 || math.Abs(end.Y) > 1e-4 {
+		t.Errorf("expected the path to end at X10 Y0, got X%f Y%f", end.X, end.Y)
+	}
+}
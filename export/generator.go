@@ -5,6 +5,7 @@ import "strconv"
 import "strings"
 import "errors"
 import "fmt"
+import "math"
 
 func floatToString(f float64, p int) string {
 	x := strconv.FormatFloat(f, 'f', p, 64)
@@ -22,6 +23,58 @@ func floatToString(f float64, p int) string {
 	return x
 }
 
+// Rounds to the given number of decimals, as floatToString would. Negative precision is exact.
+func roundTo(f float64, p int) float64 {
+	if p < 0 {
+		return f
+	}
+	m := math.Pow(10, float64(p))
+	return math.Round(f*m) / m
+}
+
+// Formats the X, Y and Z words of a move from pos, leaving out axes that do not change at the
+// given precision. If deltas is set, the words are the distances moved between rounded positions,
+// so that rounding errors do not accumulate.
+func axisWordList(pos vm.Position, x, y, z float64, precision int, deltas bool, format func(float64) string) []string {
+	var w []string
+	word := func(address string, from, to float64) {
+		from, to = roundTo(from, precision), roundTo(to, precision)
+		if from == to {
+			return
+		}
+		if deltas {
+			w = append(w, address+format(to-from))
+		} else {
+			w = append(w, address+format(to))
+		}
+	}
+	word("X", pos.X, x)
+	word("Y", pos.Y, y)
+	word("Z", pos.Z, z)
+	return w
+}
+
+// Like axisWordList, but as a single string
+func axisWords(pos vm.Position, x, y, z float64, precision int, deltas bool, format func(float64) string) string {
+	return strings.Join(axisWordList(pos, x, y, z, precision, deltas, format), "")
+}
+
+// Returns the gcode for a probe mode
+func probeCode(probeMode int) string {
+	switch probeMode {
+	case vm.ProbeModeTowardError:
+		return "G38.2"
+	case vm.ProbeModeToward:
+		return "G38.3"
+	case vm.ProbeModeAwayError:
+		return "G38.4"
+	case vm.ProbeModeAway:
+		return "G38.5"
+	default:
+		panic("Unknown probe mode")
+	}
+}
+
 // Interface for exporting a vm position stack.
 type CodeGenerator interface {
 	GetPosition() vm.Position
@@ -35,7 +88,10 @@ type CodeGenerator interface {
 	Feedrate(float64)
 	CutterCompensation(int)
 	Dwell(float64)
+	SpindleOrient()
+	Probe(float64, float64, float64, int)
 	Move(float64, float64, float64, int)
+	Arc(float64, float64, float64, float64, float64, bool)
 	Init()
 }
 
@@ -44,16 +100,19 @@ type BaseGenerator struct {
 	Position vm.Position
 }
 
-func (s *BaseGenerator) ToolChange(int)                      {}
-func (s *BaseGenerator) ToolChangeSuggestion(int)            {}
-func (s *BaseGenerator) ToolLengthChange(int)                {}
-func (s *BaseGenerator) Spindle(bool, bool, float64)         {}
-func (s *BaseGenerator) Coolant(bool, bool)                  {}
-func (s *BaseGenerator) FeedMode(int)                        {}
-func (s *BaseGenerator) Feedrate(float64)                    {}
-func (s *BaseGenerator) CutterCompensation(int)              {}
-func (s *BaseGenerator) Dwell(float64)                       {}
-func (s *BaseGenerator) Move(float64, float64, float64, int) {}
+func (s *BaseGenerator) ToolChange(int)                                        {}
+func (s *BaseGenerator) ToolChangeSuggestion(int)                              {}
+func (s *BaseGenerator) ToolLengthChange(int)                                  {}
+func (s *BaseGenerator) Spindle(bool, bool, float64)                           {}
+func (s *BaseGenerator) Coolant(bool, bool)                                    {}
+func (s *BaseGenerator) FeedMode(int)                                          {}
+func (s *BaseGenerator) Feedrate(float64)                                      {}
+func (s *BaseGenerator) CutterCompensation(int)                                {}
+func (s *BaseGenerator) Dwell(float64)                                         {}
+func (s *BaseGenerator) SpindleOrient()                                        {}
+func (s *BaseGenerator) Probe(float64, float64, float64, int)                  {}
+func (s *BaseGenerator) Move(float64, float64, float64, int)                   {}
+func (s *BaseGenerator) Arc(float64, float64, float64, float64, float64, bool) {}
 
 // Gets the current position for comparisons.
 func (s *BaseGenerator) GetPosition() vm.Position {
@@ -82,48 +141,73 @@ func HandlePosition(pos vm.Position, gens ...CodeGenerator) (err error) {
 		cs := cp.State
 		ns := pos.State
 
-		if ns.ToolIndex != cs.ToolIndex {
-			s.ToolChange(ns.ToolIndex)
-		}
+		handleState(s, cs, ns)
 
-		if ns.NextToolIndex != cs.NextToolIndex {
-			s.ToolChangeSuggestion(ns.NextToolIndex)
+		if ns.MoveMode == vm.MoveModeDwell {
+			s.Dwell(ns.DwellTime)
+		} else if ns.MoveMode == vm.MoveModeOrient {
+			s.SpindleOrient()
+		} else if ns.MoveMode == vm.MoveModeProbe {
+			s.Probe(pos.X, pos.Y, pos.Z, ns.ProbeMode)
+		} else if cp.X != pos.X || cp.Y != pos.Y || cp.Z != pos.Z || cs.MoveMode != ns.MoveMode {
+			s.Move(pos.X, pos.Y, pos.Z, ns.MoveMode)
 		}
+		s.SetPosition(pos)
+	}
+	return nil
+}
 
-		if ns.ToolLengthIndex != cs.ToolLengthIndex {
-			s.ToolLengthChange(ns.ToolLengthIndex)
+// Calls the CodeGenerator for an XY arc to pos around the center cx, cy.
+func HandleArc(pos vm.Position, cx, cy float64, clockwise bool, gens ...CodeGenerator) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("%s", r))
 		}
+	}()
+	for _, s := range gens {
+		cp := s.GetPosition()
+		handleState(s, cp.State, pos.State)
+		s.Arc(pos.X, pos.Y, pos.Z, cx-cp.X, cy-cp.Y, clockwise)
+		s.SetPosition(pos)
+	}
+	return nil
+}
 
-		if ns.SpindleEnabled != cs.SpindleEnabled ||
-			ns.SpindleClockwise != cs.SpindleClockwise ||
-			ns.SpindleSpeed != cs.SpindleSpeed {
-			s.Spindle(ns.SpindleEnabled, ns.SpindleClockwise, ns.SpindleSpeed)
-		}
+// Calls the CodeGenerator for all states changed from cs to ns, except for the move mode.
+func handleState(s CodeGenerator, cs, ns vm.State) {
+	if ns.ToolIndex != cs.ToolIndex {
+		s.ToolChange(ns.ToolIndex)
+	}
 
-		if ns.FloodCoolant != cs.FloodCoolant || ns.MistCoolant != cs.MistCoolant {
-			s.Coolant(ns.FloodCoolant, ns.MistCoolant)
-		}
+	if ns.NextToolIndex != cs.NextToolIndex {
+		s.ToolChangeSuggestion(ns.NextToolIndex)
+	}
 
-		if ns.FeedMode != cs.FeedMode {
-			s.FeedMode(ns.FeedMode)
-		}
+	if ns.ToolLengthIndex != cs.ToolLengthIndex {
+		s.ToolLengthChange(ns.ToolLengthIndex)
+	}
 
-		if ns.Feedrate != cs.Feedrate {
-			s.Feedrate(ns.Feedrate)
-		}
+	if ns.SpindleEnabled != cs.SpindleEnabled ||
+		ns.SpindleClockwise != cs.SpindleClockwise ||
+		ns.SpindleSpeed != cs.SpindleSpeed {
+		s.Spindle(ns.SpindleEnabled, ns.SpindleClockwise, ns.SpindleSpeed)
+	}
 
-		if ns.CutterCompensation != cs.CutterCompensation {
-			s.CutterCompensation(ns.CutterCompensation)
-		}
+	if ns.FloodCoolant != cs.FloodCoolant || ns.MistCoolant != cs.MistCoolant {
+		s.Coolant(ns.FloodCoolant, ns.MistCoolant)
+	}
 
-		if ns.MoveMode == vm.MoveModeDwell {
-			s.Dwell(ns.DwellTime)
-		} else if cp.X != pos.X || cp.Y != pos.Y || cp.Z != pos.Z || cs.MoveMode != ns.MoveMode {
-			s.Move(pos.X, pos.Y, pos.Z, ns.MoveMode)
-		}
-		s.SetPosition(pos)
+	if ns.FeedMode != cs.FeedMode {
+		s.FeedMode(ns.FeedMode)
+	}
+
+	if ns.Feedrate != cs.Feedrate {
+		s.Feedrate(ns.Feedrate)
+	}
+
+	if ns.CutterCompensation != cs.CutterCompensation {
+		s.CutterCompensation(ns.CutterCompensation)
 	}
-	return nil
 }
 
 // Calls HandlePosition for all positions in the vm.
@@ -136,6 +220,27 @@ func HandleAllPositions(m *vm.Machine, gens ...CodeGenerator) error {
 	return nil
 }
 
+// Like HandleAllPositions, but emits arcs for runs of linear moves that FitArcs finds within
+// tolerance of an arc, turning by at most maxSpan radians.
+func HandleAllPositionsEmitArcs(m *vm.Machine, tolerance, maxSpan float64, gens ...CodeGenerator) error {
+	arcs := FitArcs(m, tolerance, maxSpan)
+	for idx := 0; idx < len(m.Positions); idx++ {
+		if len(arcs) > 0 && arcs[0].Start == idx-1 {
+			a := arcs[0]
+			arcs = arcs[1:]
+			if err := HandleArc(m.Positions[a.End], a.CX, a.CY, a.Clockwise, gens...); err != nil {
+				return err
+			}
+			idx = a.End
+			continue
+		}
+		if err := HandlePosition(m.Positions[idx], gens...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Calls HandlePosition for all generators at an index in the vm
 func HandlePositionAtIndex(m *vm.Machine, idx int, gens ...CodeGenerator) error {
 	for _, x := range gens {
@@ -1,13 +1,17 @@
 package export
 
 import "github.com/kennylevinsen/gocnc/vm"
+import "errors"
 import "fmt"
+import "io"
+import "strings"
 
 type GrblGenerator struct {
 	BaseGenerator
 	Precision      int
 	Write          func(string)
 	ForceModeWrite bool
+	Post           PostProcessor // Formats moves, if set
 }
 
 func (s *GrblGenerator) Spindle(enabled, clockwise bool, speed float64) {
@@ -72,36 +76,97 @@ func (s *GrblGenerator) Dwell(seconds float64) {
 	s.Write(fmt.Sprintf("G4P%s", floatToString(seconds, s.Precision)))
 }
 
+func (s *GrblGenerator) SpindleOrient() {
+	panic("Spindle orientation not supported by Grbl")
+}
+
+func (s *GrblGenerator) Probe(x, y, z float64, probeMode int) {
+	s.Write(probeCode(probeMode) + s.axes(x, y, z))
+	s.ForceModeWrite = true
+}
+
 func (s *GrblGenerator) Move(x, y, z float64, moveMode int) {
 	w := ""
 	pos := s.GetPosition()
-	if pos.State.MoveMode != moveMode || s.ForceModeWrite {
-		switch moveMode {
-		case vm.MoveModeNone:
+	modal := pos.State.MoveMode == moveMode && !s.ForceModeWrite
+	switch moveMode {
+	case vm.MoveModeNone:
+		if !modal {
 			return
-		case vm.MoveModeRapid:
-			w = "G0"
-		case vm.MoveModeLinear:
-			w = "G1"
-		case vm.MoveModeCWArc:
-			panic("Cannot export arcs")
-		case vm.MoveModeCCWArc:
-			panic("Cannot export arcs")
-		default:
-			panic("Unknown move mode")
 		}
+	case vm.MoveModeRapid:
+		w = "G0"
+	case vm.MoveModeLinear:
+		w = "G1"
+	case vm.MoveModeCWArc:
+		panic("Cannot export arcs")
+	case vm.MoveModeCCWArc:
+		panic("Cannot export arcs")
+	default:
+		panic("Unknown move mode")
 	}
 	s.ForceModeWrite = false
 
-	if pos.X != x {
-		w += fmt.Sprintf("X%s", floatToString(x, s.Precision))
+	a := axisWordList(pos, x, y, z, s.Precision, false, func(f float64) string {
+		return floatToString(f, s.Precision)
+	})
+	if len(a) == 0 {
+		// Nothing changes at this precision, so keep the mode for the next move
+		s.ForceModeWrite = !modal
+		return
 	}
-	if pos.Y != y {
-		w += fmt.Sprintf("Y%s", floatToString(y, s.Precision))
+	if s.Post != nil {
+		s.Write(s.Post.FormatMove(w, modal, a))
+	} else if modal {
+		s.Write(strings.Join(a, ""))
+	} else {
+		s.Write(w + strings.Join(a, ""))
 	}
-	if pos.Z != z {
-		w += fmt.Sprintf("Z%s", floatToString(z, s.Precision))
+}
+
+func (s *GrblGenerator) Arc(x, y, z, i, j float64, clockwise bool) {
+	w := "G3"
+	if clockwise {
+		w = "G2"
 	}
+	s.Write(fmt.Sprintf("%s%sI%sJ%s", w, s.axes(x, y, z), floatToString(i, s.Precision), floatToString(j, s.Precision)))
+	s.ForceModeWrite = true
+}
 
-	s.Write(w)
+// Formats the axis words for a move from the current position
+func (s *GrblGenerator) axes(x, y, z float64) string {
+	return axisWords(s.GetPosition(), x, y, z, s.Precision, false, func(f float64) string {
+		return floatToString(f, s.Precision)
+	})
+}
+
+// Exports the machine as gcode for Grbl, formatted by GrblPost.
+// Commands that Grbl does not support, such as cutter compensation and units per revolution
+// feedrates, result in an error.
+func ToGRBL(m *vm.Machine, w io.Writer, precision int) (err error) {
+	for _, pos := range m.Positions {
+		if pos.State.FeedMode == vm.FeedModeUnitsRev {
+			return errors.New("Units per revolution feed mode not supported by Grbl")
+		}
+	}
+
+	post := GrblPost{}
+	g := &GrblGenerator{Precision: precision, Post: post}
+	g.Write = func(x string) {
+		if x != "" && err == nil {
+			_, err = io.WriteString(w, x+post.LineEnding())
+		}
+	}
+	g.Init()
+	for _, l := range post.Header() {
+		g.Write(l)
+	}
+	g.Write("G21G90")
+	if e := HandleAllPositions(m, g); e != nil {
+		return e
+	}
+	for _, l := range post.Footer() {
+		g.Write(l)
+	}
+	return err
 }
@@ -0,0 +1,74 @@
+package export
+
+import "bytes"
+import "strings"
+import "testing"
+import "github.com/kennylevinsen/gocnc/gcode"
+
+func TestToGRBL(t *testing.T) {
+	m := process(t, "G21G90\nM3S1000\nM8\nG0X0Y0Z5\nG1F100Z-1\nX10\nG2X20Y0I5J0\nG93\nG1X30F2\nG94\nG0Z5\nM5M9\n")
+	var b bytes.Buffer
+	if err := ToGRBL(m, &b, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := gcode.Parse(b.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcodes := map[float64]bool{0: true, 1: true, 4: true, 21: true, 90: true, 93: true, 94: true}
+	mcodes := map[float64]bool{2: true, 3: true, 4: true, 5: true, 7: true, 8: true, 9: true}
+	for _, block := range doc.Blocks {
+		var motion, axes bool
+		for _, n := range block.Nodes {
+			w, ok := n.(*gcode.Word)
+			if !ok {
+				continue
+			}
+			switch w.Address {
+			case 'G':
+				if !gcodes[w.Command] {
+					t.Errorf("unsupported code in %s", block.Export(-1))
+				}
+				motion = motion || w.Command == 0 || w.Command == 1
+			case 'M':
+				if !mcodes[w.Command] {
+					t.Errorf("unsupported code in %s", block.Export(-1))
+				}
+			case 'X', 'Y', 'Z':
+				axes = true
+			case 'F', 'S', 'P':
+			default:
+				t.Errorf("unsupported word in %s", block.Export(-1))
+			}
+		}
+		if axes && !motion {
+			t.Errorf("move without a motion word: %s", block.Export(-1))
+		}
+	}
+}
+
+func TestToGRBLUnsupported(t *testing.T) {
+	m := process(t, "G21G90\nM3S1000\nG95\nG1F0.1X10\n")
+	var b bytes.Buffer
+	if err := ToGRBL(m, &b, 4); err == nil {
+		t.Errorf("expected units per revolution feed mode to be rejected")
+	}
+
+	m = process(t, "G21G90\nG41\nG1F100X10\n")
+	if err := ToGRBL(m, &b, 4); err == nil {
+		t.Errorf("expected cutter compensation to be rejected")
+	}
+
+	// Streaming through the generator itself keeps writing G95
+	m = process(t, "G21G90\nM3S1000\nG95\nG1F0.1X10\n")
+	var lines []string
+	g := &GrblGenerator{Precision: 4, Write: func(s string) { lines = append(lines, s) }}
+	g.Init()
+	if err := HandleAllPositions(m, g); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Join(lines, "\n"), "G95") {
+		t.Errorf("expected G95 in %v", lines)
+	}
+}
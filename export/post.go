@@ -0,0 +1,77 @@
+package export
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "io"
+import "strings"
+
+//
+// Post processors
+//
+// Used by StringCodeGenerator for controller specific output
+//
+
+// Controller specific formatting of generated gcode.
+type PostProcessor interface {
+	Header() []string // Lines before the program
+	Footer() []string // Lines after the program
+	LineEnding() string
+
+	// Formats a move from its motion word (G0/G1) and axis words. If modal is set, the motion
+	// word is already in effect, and may be left out.
+	FormatMove(motion string, modal bool, words []string) string
+}
+
+// LinuxCNC, with compact words and M2 to end the program.
+type LinuxCNCPost struct{}
+
+func (LinuxCNCPost) Header() []string   { return nil }
+func (LinuxCNCPost) Footer() []string   { return []string{"M2"} }
+func (LinuxCNCPost) LineEnding() string { return "\n" }
+
+func (LinuxCNCPost) FormatMove(motion string, modal bool, words []string) string {
+	if modal {
+		motion = ""
+	}
+	return motion + strings.Join(words, "")
+}
+
+// Grbl, writing the motion word on every move, as some senders require it. Also used by ToGRBL.
+type GrblPost struct{}
+
+func (GrblPost) Header() []string   { return nil }
+func (GrblPost) Footer() []string   { return []string{"M2"} }
+func (GrblPost) LineEnding() string { return "\n" }
+
+func (GrblPost) FormatMove(motion string, modal bool, words []string) string {
+	return motion + strings.Join(words, "")
+}
+
+// Mach3, with space separated words, percent sign wrappers, CRLF line endings and M30 to end the
+// program.
+type Mach3Post struct{}
+
+func (Mach3Post) Header() []string   { return []string{"%"} }
+func (Mach3Post) Footer() []string   { return []string{"M30", "%"} }
+func (Mach3Post) LineEnding() string { return "\r\n" }
+
+func (Mach3Post) FormatMove(motion string, modal bool, words []string) string {
+	if !modal {
+		words = append([]string{motion}, words...)
+	}
+	return strings.Join(words, " ")
+}
+
+// Exports the machine as gcode, formatted by the given post processor, or LinuxCNCPost if nil.
+func ToGCode(m *vm.Machine, w io.Writer, precision int, post PostProcessor) error {
+	if post == nil {
+		post = LinuxCNCPost{}
+	}
+	g := &StringCodeGenerator{Precision: precision, Post: post}
+	g.Init()
+	if err := HandleAllPositions(m, g); err != nil {
+		return err
+	}
+	g.Finish()
+	_, err := io.WriteString(w, g.Retrieve()+post.LineEnding())
+	return err
+}
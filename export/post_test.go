@@ -0,0 +1,26 @@
+package export
+
+import "bytes"
+import "testing"
+
+func TestToGCodePosts(t *testing.T) {
+	src := "G21G90\nG0X0Y0Z5\nG1F100Z-1\nX10\nY10\nG0Z5\n"
+	tests := []struct {
+		post     PostProcessor
+		expected string
+	}{
+		{nil, "(Exported by gocnc)\nG21G90\n\nG0Z5\nF100\nG1Z-1\nX10\nY10\nG0Z5\nM2\n"},
+		{LinuxCNCPost{}, "(Exported by gocnc)\nG21G90\n\nG0Z5\nF100\nG1Z-1\nX10\nY10\nG0Z5\nM2\n"},
+		{GrblPost{}, "(Exported by gocnc)\nG21G90\n\nG0Z5\nF100\nG1Z-1\nG1X10\nG1Y10\nG0Z5\nM2\n"},
+		{Mach3Post{}, "%\r\n(Exported by gocnc)\r\nG21G90\r\n\r\nG0 Z5\r\nF100\r\nG1 Z-1\r\nX10\r\nY10\r\nG0 Z5\r\nM30\r\n%\r\n"},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := ToGCode(process(t, src), &b, 4, test.post); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.expected {
+			t.Errorf("%T: expected %q, got %q", test.post, test.expected, b.String())
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package export
 
+import "github.com/kennylevinsen/gocnc/gcode"
 import "github.com/kennylevinsen/gocnc/vm"
 import "fmt"
+import "strconv"
 import "strings"
 
 //
@@ -11,28 +13,80 @@ import "strings"
 //
 // Notes:
 //   Inverse time feed requires F to be set for every G-word, which is not done
+//   Incremental output assumes that the machine starts at X0 Y0 Z0
 //
 
+// Ways of expressing dwell time
+type DwellStyle int
+
+const (
+	DwellSeconds      DwellStyle = iota // G4Pn, with n in seconds
+	DwellSecondsS     DwellStyle = iota // G4Sn, with n in seconds
+	DwellMilliseconds DwellStyle = iota // G4Pn, with n in milliseconds
+)
+
 type StringCodeGenerator struct {
 	BaseGenerator
 	Precision      int
+	Incremental    bool
+	DwellStyle     DwellStyle
+	TrailingZeros  bool // Keep trailing zeroes of numbers at the given precision
 	Lines          []string
 	Tool           int
 	ForceModeWrite bool
+	ToolSummary    []vm.ToolUse  // Listed as comments in the header
+	Post           PostProcessor // Controller specific formatting, if set
 }
 
 // Initializes state, and puts in a header block.
 func (s *StringCodeGenerator) Init() {
 	s.Position = vm.Position{State: vm.NewState()}
-	s.Lines = []string{"(Exported by gocnc)", "G21G90\n"}
+	s.Lines = nil
+	if s.Post != nil {
+		s.Lines = append(s.Lines, s.Post.Header()...)
+	}
+	s.put("(Exported by gocnc)")
+	for _, t := range s.ToolSummary {
+		s.put(fmt.Sprintf("(T%d: first used at position %d, %d moves)", t.Tool, t.FirstIndex, t.Moves))
+	}
+	if s.Incremental {
+		s.put("G21G91")
+	} else {
+		s.put("G21G90")
+	}
+	s.put("")
+}
+
+// Formats a number at the configured precision
+func (s *StringCodeGenerator) format(f float64) string {
+	if f = roundTo(f, s.Precision); f == 0 {
+		// Avoid emitting negative zero
+		f = 0
+	}
+	if s.TrailingZeros {
+		return strconv.FormatFloat(f, 'f', s.Precision, 64)
+	}
+	return floatToString(f, s.Precision)
 }
 
 func (s *StringCodeGenerator) put(x string) {
 	s.Lines = append(s.Lines, x)
 }
 
+// Puts in the footer of the post processor, if any.
+func (s *StringCodeGenerator) Finish() {
+	if s.Post != nil {
+		for _, l := range s.Post.Footer() {
+			s.put(l)
+		}
+	}
+}
+
 // Fetch the generated gcodes.
 func (s *StringCodeGenerator) Retrieve() string {
+	if s.Post != nil {
+		return strings.Join(s.Lines, s.Post.LineEnding())
+	}
 	return strings.Join(s.Lines, "\n")
 }
 
@@ -85,7 +139,7 @@ func (s *StringCodeGenerator) Spindle(enabled, clockwise bool, speed float64) {
 	}
 
 	if enabled && s.Position.State.SpindleSpeed != speed {
-		x += fmt.Sprintf("S%s", floatToString(speed, s.Precision))
+		x += fmt.Sprintf("S%s", s.format(speed))
 	}
 
 	s.put(x)
@@ -122,7 +176,7 @@ func (s *StringCodeGenerator) FeedMode(feedMode int) {
 
 // Sets feedrate (Fn)
 func (s *StringCodeGenerator) Feedrate(feedrate float64) {
-	s.put(fmt.Sprintf("F%s", floatToString(feedrate, s.Precision)))
+	s.put(fmt.Sprintf("F%s", s.format(feedrate)))
 }
 
 // Sets cutter compensation mode (G40/G41/G42)
@@ -139,42 +193,100 @@ func (s *StringCodeGenerator) CutterCompensation(cutComp int) {
 	}
 }
 
+// Adds a dwell (G4 [Pn] [Sn]) in the configured dwell style
 func (s *StringCodeGenerator) Dwell(seconds float64) {
-	s.put(fmt.Sprintf("G4P%s", floatToString(seconds, s.Precision)))
+	switch s.DwellStyle {
+	case DwellSecondsS:
+		s.put(fmt.Sprintf("G4S%s", s.format(seconds)))
+	case DwellMilliseconds:
+		s.put(fmt.Sprintf("G4P%s", s.format(seconds*1000)))
+	default:
+		s.put(fmt.Sprintf("G4P%s", s.format(seconds)))
+	}
+}
+
+// Adds a spindle orientation (M19)
+func (s *StringCodeGenerator) SpindleOrient() {
+	s.put("M19")
 }
 
 // Issues a move ([G0/G1] [Xn] [Yn] [Zn])
 func (s *StringCodeGenerator) Move(x, y, z float64, moveMode int) {
-	w := ""
 	pos := s.GetPosition()
-	if pos.State.MoveMode != moveMode || s.ForceModeWrite {
-		switch moveMode {
-		case vm.MoveModeNone:
+	modal := pos.State.MoveMode == moveMode && !s.ForceModeWrite
+
+	w := ""
+	switch moveMode {
+	case vm.MoveModeNone:
+		if !modal {
 			return
-		case vm.MoveModeRapid:
-			w = "G0"
-		case vm.MoveModeLinear:
-			w = "G1"
-		case vm.MoveModeCWArc:
-			panic("Cannot export arcs")
-		case vm.MoveModeCCWArc:
-			panic("Cannot export arcs")
-		default:
-			panic("Unknown move mode")
 		}
+	case vm.MoveModeRapid:
+		w = "G0"
+	case vm.MoveModeLinear:
+		w = "G1"
+	case vm.MoveModeCWArc:
+		panic("Cannot export arcs")
+	case vm.MoveModeCCWArc:
+		panic("Cannot export arcs")
+	default:
+		panic("Unknown move mode")
 	}
 
 	s.ForceModeWrite = false
 
-	if pos.X != x {
-		w += fmt.Sprintf("X%s", floatToString(x, s.Precision))
+	words := axisWordList(pos, x, y, z, s.Precision, s.Incremental, s.format)
+	if len(words) == 0 {
+		// Nothing changes at this precision, so keep the mode for the next move
+		s.ForceModeWrite = !modal
+		return
 	}
-	if pos.Y != y {
-		w += fmt.Sprintf("Y%s", floatToString(y, s.Precision))
+	if s.Post != nil {
+		s.put(s.Post.FormatMove(w, modal, words))
+	} else if modal {
+		s.put(strings.Join(words, ""))
+	} else {
+		s.put(w + strings.Join(words, ""))
 	}
-	if pos.Z != z {
-		w += fmt.Sprintf("Z%s", floatToString(z, s.Precision))
+}
+
+// Issues an XY arc (G2/G3 [Xn] [Yn] [Zn] In Jn), with the center relative to the current position
+func (s *StringCodeGenerator) Arc(x, y, z, i, j float64, clockwise bool) {
+	w := "G3"
+	if clockwise {
+		w = "G2"
+	}
+	words := axisWordList(s.GetPosition(), x, y, z, s.Precision, s.Incremental, s.format)
+	words = append(words, "I"+s.format(i), "J"+s.format(j))
+	if s.Post != nil {
+		s.put(s.Post.FormatMove(w, false, words))
+	} else {
+		s.put(w + strings.Join(words, ""))
 	}
+	s.ForceModeWrite = true
+}
+
+// Issues a probe (G38.2/G38.3/G38.4/G38.5 [Xn] [Yn] [Zn])
+func (s *StringCodeGenerator) Probe(x, y, z float64, probeMode int) {
+	s.put(probeCode(probeMode) + s.axes(x, y, z))
+	s.ForceModeWrite = true
+}
 
-	s.put(w)
+// Formats the axis words for a move from the current position
+func (s *StringCodeGenerator) axes(x, y, z float64) string {
+	return axisWords(s.GetPosition(), x, y, z, s.Precision, s.Incremental, s.format)
+}
+
+// Exports the machine as a gcode document, at full precision.
+func ToDocument(m *vm.Machine) (gcode.Document, error) {
+	g := &StringCodeGenerator{Precision: -1}
+	g.Init()
+	if err := HandleAllPositions(m, g); err != nil {
+		return gcode.Document{}, err
+	}
+	doc, err := gcode.Parse(g.Retrieve())
+	if err != nil {
+		return gcode.Document{}, err
+	}
+	return *doc, nil
 }
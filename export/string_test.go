@@ -0,0 +1,157 @@
+package export
+
+import "math"
+import "strings"
+import "testing"
+import "github.com/kennylevinsen/gocnc/optimize"
+import "github.com/kennylevinsen/gocnc/vm"
+
+// Exports the machine through the generator, and returns the result
+func export(t *testing.T, m *vm.Machine, g *StringCodeGenerator) string {
+	g.Init()
+	if err := HandleAllPositions(m, g); err != nil {
+		t.Fatal(err)
+	}
+	g.Finish()
+	return g.Retrieve()
+}
+
+// Tests if src contains the given line
+func hasLine(src, line string) bool {
+	for _, l := range strings.Split(src, "\n") {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that the two machines move through the same points
+func samePath(t *testing.T, a, b *vm.Machine) {
+	points := func(m *vm.Machine) []vm.Position {
+		var res []vm.Position
+		for _, pos := range m.Positions {
+			if pos.State.MoveMode != vm.MoveModeNone {
+				res = append(res, pos)
+			}
+		}
+		return res
+	}
+	pa, pb := points(a), points(b)
+	if len(pa) != len(pb) {
+		t.Fatalf("expected %d moves, got %d", len(pa), len(pb))
+	}
+	for idx := range pa {
+		if pa[idx].Vector().Diff(pb[idx].Vector()).Norm() > 1e-6 {
+			t.Errorf("move %d: expected %v, got %v", idx, pa[idx].Vector(), pb[idx].Vector())
+		}
+	}
+}
+
+func TestIncrementalExport(t *testing.T) {
+	m := process(t, "G21G90\nG0X5Y5Z5\nG1F100Z-1\nX15\nY-5\nX5.5Y5.25\nG0Z5\n")
+	src := export(t, m, &StringCodeGenerator{Precision: 5, Incremental: true})
+	if !strings.Contains(src, "G91") {
+		t.Errorf("expected incremental mode to be set:\n%s", src)
+	}
+	samePath(t, m, process(t, src))
+
+	// Arc centers stay relative to the start of the arc
+	m = process(t, "G21G90\nG0X5Y5\nG1F100X15\nG3X5Y15I-10J0\n")
+	g := &StringCodeGenerator{Precision: 5, Incremental: true}
+	g.Init()
+	if err := HandleAllPositionsEmitArcs(m, 0.01, math.Pi, g); err != nil {
+		t.Fatal(err)
+	}
+	src = g.Retrieve()
+	if !strings.Contains(src, "G3X-10Y10I-10J0") {
+		t.Errorf("expected an incremental arc:\n%s", src)
+	}
+	samePath(t, process(t, "G21G90\nG0X5Y5\nG1F100X15\nG3X5Y15I-10J0\n"), process(t, src))
+}
+
+func TestProbeExport(t *testing.T) {
+	m := process(t, "G21G90\nG0X10Y10Z5\nG38.2Z-10F50\nG0Z5\nG1F100X20\nX30\n")
+	optimize.OptBogusMoves(m)
+	optimize.OptVector(m, 0.001, false)
+	src := export(t, m, &StringCodeGenerator{Precision: 5})
+	if !strings.Contains(src, "G38.2Z-10") {
+		t.Errorf("expected the probe to be re-emitted:\n%s", src)
+	}
+	if strings.Contains(src, "X20") {
+		t.Errorf("expected the moves after the probe to be merged:\n%s", src)
+	}
+}
+
+func TestToolSummaryHeader(t *testing.T) {
+	m := process(t, "G21G90\nT2M6\nG0X1\nT1M6\nG0X3\n")
+	src := export(t, m, &StringCodeGenerator{Precision: 5, ToolSummary: m.ToolSummary()})
+	header := "(T2: first used at position 1, 1 moves)\n(T1: first used at position 2, 1 moves)\n"
+	if !strings.Contains(src, header) {
+		t.Errorf("expected the tool summary in the header:\n%s", src)
+	}
+}
+
+func TestDwellStyle(t *testing.T) {
+	m := process(t, "G21G90\nG1F100X10\nG4P1.5\n")
+	expected := map[DwellStyle]string{
+		DwellSeconds:      "G4P1.5",
+		DwellSecondsS:     "G4S1.5",
+		DwellMilliseconds: "G4P1500",
+	}
+	for style, dwell := range expected {
+		src := export(t, m, &StringCodeGenerator{Precision: 5, DwellStyle: style})
+		if !hasLine(src, dwell) {
+			t.Errorf("style %d: expected %s in:\n%s", style, dwell, src)
+		}
+	}
+}
+
+func TestPrecision(t *testing.T) {
+	m := process(t, "G21G90\nG1F100X1.23456Y1.5\n")
+	expected := []struct {
+		g    *StringCodeGenerator
+		move string
+	}{
+		{&StringCodeGenerator{Precision: 3}, "G1X1.235Y1.5"},
+		{&StringCodeGenerator{Precision: 4}, "G1X1.2346Y1.5"},
+		{&StringCodeGenerator{Precision: 3, TrailingZeros: true}, "G1X1.235Y1.500"},
+		{&StringCodeGenerator{Precision: 4, TrailingZeros: true}, "G1X1.2346Y1.5000"},
+	}
+	for _, e := range expected {
+		if src := export(t, m, e.g); !hasLine(src, e.move) {
+			t.Errorf("expected %s in:\n%s", e.move, src)
+		}
+	}
+}
+
+func TestRedundantAxisWords(t *testing.T) {
+	m := process(t, "G21G90\nG0X1Y2Z3\nG1F100Y5\nX1.00001\n")
+	src := export(t, m, &StringCodeGenerator{Precision: 3})
+	if !hasLine(src, "G1Y5") {
+		t.Errorf("expected only the Y word to be emitted:\n%s", src)
+	}
+	if strings.Contains(src, "X1.00001") || strings.Count(src, "X1") != 1 {
+		t.Errorf("expected the move within precision to be dropped:\n%s", src)
+	}
+}
+
+func TestToDocument(t *testing.T) {
+	src := "G21G90\nG0X5Y5Z5\nG1F100Z-1\nX15\nY15\nG0Z5\n"
+	m := process(t, src)
+	doc, err := ToDocument(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(export(t, m, &StringCodeGenerator{Precision: -1}), "\n")
+	if len(doc.Blocks) != len(lines) {
+		t.Errorf("expected %d blocks, got %d", len(lines), len(doc.Blocks))
+	}
+
+	var r vm.Machine
+	r.Init()
+	if err := r.Process(&doc); err != nil {
+		t.Fatal(err)
+	}
+	samePath(t, m, &r)
+}
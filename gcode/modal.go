@@ -108,6 +108,7 @@ var (
 		"spindleGroup": {&Word{'M', 3},
 			&Word{'M', 4},
 			&Word{'M', 5},
+			&Word{'M', 19},
 		},
 		"coolantGroup": {&Word{'M', 7},
 			&Word{'M', 8},
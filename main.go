@@ -38,24 +38,45 @@ var (
 	optDrillSpeed   = kingpin.Flag("optdrill", "Use fast positioning for drills to last drilled depth").Default("false").Bool()
 	optFloatingZ    = kingpin.Flag("optfloat", "Remove bogus moves above Z0 (floating Z)").Default("true").Bool()
 	optPathGrouping = kingpin.Flag("optpath", "Optimize path to minimize moves between individual operations").Default("false").Bool()
+	optContourOrder = kingpin.Flag("optcontour", "Reorder operations to minimize travel between them").Default("false").Bool()
+	optZigZag       = kingpin.Flag("optzigzag", "Reverse every other pass of one-directional rasters").Default("false").Bool()
+	optReplunge     = kingpin.Flag("optreplunge", "Remove retracts that plunge straight back down").Default("false").Bool()
 	optPrepareTool  = kingpin.Flag("optpreparetool", "Ensures that the next tool is prepared as long in advance as possible").Default("false").Bool()
 
 	precision        = kingpin.Flag("precision", "Precision to use for exported gcode (max mantissa digits)").Default("4").Int()
+	incremental      = kingpin.Flag("incremental", "Use incremental (G91) coordinates for exported gcode").Bool()
+	trailingZeros    = kingpin.Flag("trailingzeros", "Keep trailing zeroes of numbers in exported gcode").Bool()
+	dwellStyle       = kingpin.Flag("dwellstyle", "Dwell style for exported gcode (p: G4P in seconds, s: G4S in seconds, ms: G4P in milliseconds)").Default("p").Enum("p", "s", "ms")
+	post             = kingpin.Flag("post", "Post processor for exported gcode").Default("none").Enum("none", "linuxcnc", "grbl", "mach3")
+	emitArcs         = kingpin.Flag("emitarcs", "Emit arcs for linear moves within the given tolerance of an arc in exported gcode (mm, 0 to disable)").Default("0").Float()
+	emitArcSpan      = kingpin.Flag("emitarcspan", "Maximum total turn of emitted arcs (radians)").Default("3.14159").Float()
+	toolSummary      = kingpin.Flag("toolsummary", "List used tools as comments in the header of exported gcode").Bool()
 	maxArcDeviation  = kingpin.Flag("maxarcdeviation", "Maximum deviation from an ideal arc (mm)").Default("0.002").Float()
 	minArcLineLength = kingpin.Flag("minarclinelength", "Minimum arc segment line length (mm)").Default("0.01").Float()
+	arcSegments      = kingpin.Flag("arcsegments", "Fixed number of segments per arc, overriding deviation and line length (0 to disable)").Default("0").Int()
 	rtolerance       = kingpin.Flag("rtolerance", "Tolerance used by route grouping (mm)").Default("0.001").Float()
-	vtolerance       = kingpin.Flag("vtolerance", "Tolerance used by vector optimization (mm)").Default("0.0003").Float()
+	rclearancegap    = kingpin.Flag("rclearancegap", "Maximum gap for route grouping to move at clearance height instead of safety height (mm, 0 to disable)").Default("0").Float()
+	rclearance       = kingpin.Flag("rclearance", "Clearance above the cut depth used by route grouping between nearby operations (mm)").Default("1").Float()
+	vtolerance       = kingpin.Flag("vtolerance", "Tolerance used by vector optimization (mm), or 0 to use the program's G64 P").Default("0.0003").Float()
+	vmergefeeds      = kingpin.Flag("vmergefeeds", "Merge moves with different feedrates during vector optimization").Default("true").Bool()
 	rapiddrill       = kingpin.Flag("rapiddrill", "Use rapid moves for drills optimizations").Default("false").Bool()
 	drillfeed        = kingpin.Flag("dillfeed", "Feedrage to use for drill optimizations").Default("1000").Float()
 	floatingzheight  = kingpin.Flag("floatingzheight", "Z height required to consider a move floating").Default("1").Float()
 
 	feedLimit    = kingpin.Flag("feedlimit", "Maximum feedrate (mm/min, <= 0 to disable)").Float()
+	feedFloor    = kingpin.Flag("feedfloor", "Minimum cutting feedrate (mm/min, <= 0 to disable)").Float()
 	safetyHeight = kingpin.Flag("safetyheight", "Enforce safety height (mm, <= 0 to disable)").Float()
+	safetyClear  = kingpin.Flag("safetyclearance", "Enforce safety height at the given clearance above the highest cut, overriding safetyheight (mm, <= 0 to disable)").Float()
 	multiplyFeed = kingpin.Flag("multiplyfeed", "Feedrate multiplier (0 to disable)").Float()
 	multiplyMove = kingpin.Flag("multiplymove", "Move distance multiplier (0 to disable)").Float()
+	retractFeed  = kingpin.Flag("retractfeed", "Feedrate for retracts instead of rapids (mm/min, <= 0 to disable)").Float()
+	backlashX    = kingpin.Flag("backlashx", "X axis backlash compensation (mm, <= 0 to disable)").Float()
+	backlashY    = kingpin.Flag("backlashy", "Y axis backlash compensation (mm, <= 0 to disable)").Float()
+	backlashZ    = kingpin.Flag("backlashz", "Z axis backlash compensation (mm, <= 0 to disable)").Float()
 
 	spindleCW  = kingpin.Flag("spindlecw", "Force clockwise spindle speed (RPM, <= 0 to disable)").Float()
 	spindleCCW = kingpin.Flag("spindleccw", "Force counter clockwise spindle speed (RPM, <= 0 to disable)").Float()
+	laserPower = kingpin.Flag("laserpower", "Laser mode, scaling power (S) with feedrate by the given ratio (<= 0 to disable)").Float()
 
 	enforceReturn    = kingpin.Flag("enforcereturn", "Enforce rapid return to X0 Y0 Z0").Default("true").Bool()
 	flipXY           = kingpin.Flag("flipxy", "Flips the X and Y axes for all moves").Bool()
@@ -65,11 +86,25 @@ var (
 	spindleWait      = kingpin.Flag("spindlewait", "Seconds to dwell after spindle changes").Int()
 	coolantWait      = kingpin.Flag("coolantwait", "Seconds to dwell after coolant changes").Int()
 	toolchangeHeight = kingpin.Flag("tcheight", "Height to go to for toolchange (0 to use safety height)").Default("0").Float()
+	toolchangeRoute  = kingpin.Flag("tcroute", "Route all tool changes through the toolchange position").Bool()
+	toolchangeX      = kingpin.Flag("tcx", "X position to go to for toolchange").Default("0").Float()
+	toolchangeY      = kingpin.Flag("tcy", "Y position to go to for toolchange").Default("0").Float()
 )
 
 var (
-	generators []export.CodeGenerator
-	machine    vm.Machine
+	generators  []export.CodeGenerator
+	machine     vm.Machine
+	dwellStyles = map[string]export.DwellStyle{
+		"p":  export.DwellSeconds,
+		"s":  export.DwellSecondsS,
+		"ms": export.DwellMilliseconds,
+	}
+
+	posts = map[string]export.PostProcessor{
+		"linuxcnc": export.LinuxCNCPost{},
+		"grbl":     export.GrblPost{},
+		"mach3":    export.Mach3Post{},
+	}
 )
 
 //
@@ -291,6 +326,7 @@ func main() {
 	machine.AllowRemainingWords = *allowRemainingWords
 	machine.MaxArcDeviation = *maxArcDeviation
 	machine.MinArcLineLength = *minArcLineLength
+	machine.ArcSegmentsOverride = *arcSegments
 
 	if err := machine.Process(document); err != nil {
 		fmt.Fprintf(os.Stderr, "VM failed: %s\n", err)
@@ -308,17 +344,33 @@ func main() {
 		}
 
 		if *optPathGrouping {
-			if err := optimize.OptPathGrouping(&machine, *rtolerance); err != nil {
+			if err := optimize.OptPathGroupingClearance(&machine, *rtolerance, *rclearancegap, *rclearance); err != nil {
 				fmt.Fprintf(os.Stderr, "Warning: Could not execute path grouping: %s\n", err)
 			}
 		}
 
+		if *optContourOrder {
+			if err := optimize.OptContourOrder(&machine); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Could not execute contour ordering: %s\n", err)
+			}
+		}
+
+		if *optZigZag {
+			if err := optimize.OptZigZag(&machine); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Could not execute zig-zag reordering: %s\n", err)
+			}
+		}
+
+		if *optReplunge {
+			optimize.OptRemoveRedundantReplunge(&machine, *rtolerance)
+		}
+
 		if *optBogusMove {
 			optimize.OptBogusMoves(&machine)
 		}
 
 		if *optVector {
-			optimize.OptVector(&machine, *vtolerance)
+			optimize.OptVector(&machine, *vtolerance, *vmergefeeds)
 		}
 
 		if *optLiftSpeed {
@@ -335,14 +387,18 @@ func main() {
 		machine.FlipXY()
 	}
 
-	if *safetyHeight > 0 {
+	if *safetyClear > 0 {
+		if err := machine.SetSafetyHeight(machine.OptimalSafetyHeight(*safetyClear)); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not set safety height%s\n", err)
+		}
+	} else if *safetyHeight > 0 {
 		if err := machine.SetSafetyHeight(*safetyHeight); err != nil {
 			fmt.Fprintf(os.Stderr, "Warning: Could not set safety height%s\n", err)
 		}
 	}
 
-	if *feedLimit > 0 {
-		machine.LimitFeedrate(*feedLimit)
+	if *feedLimit > 0 || *feedFloor > 0 {
+		machine.ClampFeedrate(*feedFloor, *feedLimit)
 	}
 
 	if *multiplyFeed != 0 {
@@ -353,16 +409,37 @@ func main() {
 		machine.MoveMultiplier(*multiplyMove)
 	}
 
+	if *toolchangeRoute {
+		machine.ToolChangePos = [3]float64{*toolchangeX, *toolchangeY, *toolchangeHeight}
+		if *toolchangeHeight == 0 {
+			machine.ToolChangePos[2] = machine.FindSafetyHeight()
+		}
+		machine.EnforceToolChangeRetract()
+	}
+
 	if *enforceReturn {
 		machine.Return(true, true)
 	}
 
+	if *retractFeed > 0 {
+		machine.SetRetractFeed(*retractFeed)
+	}
+
 	if *spindleCW > 0 {
 		machine.EnforceSpindle(true, true, *spindleCW)
 	} else if *spindleCCW > 0 {
 		machine.EnforceSpindle(true, false, *spindleCCW)
 	}
 
+	if *laserPower > 0 {
+		machine.LaserMode = true
+		machine.ScaleLaserPower(*laserPower)
+	}
+
+	if *backlashX > 0 || *backlashY > 0 || *backlashZ > 0 {
+		machine.AddBacklashComp(*backlashX, *backlashY, *backlashZ)
+	}
+
 	if *stats {
 		printStats(&machine)
 	}
@@ -377,16 +454,32 @@ func main() {
 	}
 
 	if *dumpStdout {
-		g := export.StringCodeGenerator{Precision: *precision}
+		g := export.StringCodeGenerator{Precision: *precision, Incremental: *incremental, DwellStyle: dwellStyles[*dwellStyle], TrailingZeros: *trailingZeros, Post: posts[*post]}
+		if *toolSummary {
+			g.ToolSummary = machine.ToolSummary()
+		}
 		g.Init()
-		export.HandleAllPositions(&machine, &g)
+		if *emitArcs > 0 {
+			export.HandleAllPositionsEmitArcs(&machine, *emitArcs, *emitArcSpan, &g)
+		} else {
+			export.HandleAllPositions(&machine, &g)
+		}
+		g.Finish()
 		fmt.Printf(g.Retrieve())
 	}
 
 	if *outputFile != "" {
-		g := export.StringCodeGenerator{Precision: *precision}
+		g := export.StringCodeGenerator{Precision: *precision, Incremental: *incremental, DwellStyle: dwellStyles[*dwellStyle], TrailingZeros: *trailingZeros, Post: posts[*post]}
+		if *toolSummary {
+			g.ToolSummary = machine.ToolSummary()
+		}
 		g.Init()
-		export.HandleAllPositions(&machine, &g)
+		if *emitArcs > 0 {
+			export.HandleAllPositionsEmitArcs(&machine, *emitArcs, *emitArcSpan, &g)
+		} else {
+			export.HandleAllPositions(&machine, &g)
+		}
+		g.Finish()
 
 		if err := ioutil.WriteFile(*outputFile, []byte(g.Retrieve()), 0644); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: Could not write to file: %s\n", err)
@@ -7,18 +7,22 @@ import "github.com/kennylevinsen/gocnc/vector"
 // Calculates the unit-vector, and kills all incremental moves between A and B.
 // Deprecated by OptVector.
 func OptBogusMoves(machine *vm.Machine) {
+	machine.Record("OptBogusMoves")
 	var (
 		lastvec vector.Vector
 		state   vector.Vector
 		npos    []vm.Position = make([]vm.Position, 0)
+		origins []int         = make([]int, 0)
 	)
 
-	for _, m := range machine.Positions {
+	for idx, m := range machine.Positions {
 		d := m.Vector().Diff(state)
 		state = m.Vector()
 
-		if m.State.MoveMode != vm.MoveModeRapid && m.State.MoveMode != vm.MoveModeLinear {
+		if !isMove(m) {
 			lastvec = vector.Vector{}
+			npos = append(npos, m)
+			origins = append(origins, idx)
 			continue
 		}
 
@@ -32,10 +36,12 @@ func OptBogusMoves(machine *vm.Machine) {
 
 		if vec == lastvec {
 			npos[len(npos)-1] = m
+			origins[len(origins)-1] = idx
 		} else {
 			npos = append(npos, m)
+			origins = append(origins, idx)
 			lastvec = vec
 		}
 	}
-	machine.Positions = npos
+	setPositions(machine, npos, origins)
 }
@@ -0,0 +1,43 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+
+import "math"
+
+// Reorders operations to minimize travel between them.
+// Operations (runs of positions below the stock top) are kept intact, including their direction,
+// and visited nearest-first, starting with the original first operation. Travel between
+// operations is done at safety height, descending to the original approach height before plunging.
+// This optimization pass bails if tools change between operations, or if anything but plain moves
+// are found between them.
+func OptContourOrder(machine *vm.Machine) error {
+	ops, safetyHeight, err := reorderableOperations(machine)
+	if err != nil {
+		return err
+	} else if len(ops) < 2 {
+		return nil
+	}
+
+	passes := extractPasses(machine, ops, safetyHeight)
+	sorted := []pass{passes[0]}
+	remaining := passes[1:]
+	for len(remaining) > 0 {
+		cur := sorted[len(sorted)-1].positions
+		end := cur[len(cur)-1]
+		selected := 0
+		best := math.Inf(1)
+		for idx, p := range remaining {
+			diff := math.Hypot(p.positions[0].X-end.X, p.positions[0].Y-end.Y)
+			if diff < best {
+				selected, best = idx, diff
+			}
+		}
+
+		sorted = append(sorted, remaining[selected])
+		remaining = append(remaining[:selected], remaining[selected+1:]...)
+	}
+
+	rebuildPasses(machine, ops, sorted, safetyHeight)
+	machine.Record("OptContourOrder")
+	return nil
+}
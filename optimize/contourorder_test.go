@@ -0,0 +1,80 @@
+package optimize
+
+import "fmt"
+import "math"
+import "testing"
+import "github.com/kennylevinsen/gocnc/vm"
+
+// Total XY distance covered by rapid moves
+func rapidTravel(m *vm.Machine) float64 {
+	var res float64
+	for idx := 1; idx < len(m.Positions); idx++ {
+		a, b := m.Positions[idx-1], m.Positions[idx]
+		if b.State.MoveMode == vm.MoveModeRapid {
+			res += math.Hypot(b.X-a.X, b.Y-a.Y)
+		}
+	}
+	return res
+}
+
+// A closed square contour of side 5 at the given corner
+func square(x, y float64) string {
+	return fmt.Sprintf("G0X%gY%g\nG1F100Z-1\nX%g\nY%g\nX%g\nY%g\nG0Z5\n", x, y, x+5, y+5, x, y)
+}
+
+func TestOptContourOrder(t *testing.T) {
+	src := "G21G90\nG0Z5\n" + square(0, 0) + square(100, 0) + square(10, 0) + square(90, 0) + square(20, 0)
+	m := process(t, src)
+	cuts := m.Operations()
+	before := rapidTravel(m)
+	if err := OptContourOrder(m); err != nil {
+		t.Fatal(err)
+	}
+	if after := rapidTravel(m); after >= before {
+		t.Errorf("expected less rapid travel than %f, got %f", before, after)
+	}
+
+	// Every contour is kept intact
+	ops := m.Operations()
+	if len(ops) != len(cuts) {
+		t.Fatalf("expected %d operations, got %d", len(cuts), len(ops))
+	}
+	order := []float64{0, 10, 20, 90, 100}
+	for idx, op := range ops {
+		start := m.Positions[op.Start]
+		if start.X != order[idx] || op.End-op.Start != 5 {
+			t.Errorf("operation %d: expected a contour at X%v, got %d moves at %v", idx, order[idx], op.End-op.Start, start.Vector())
+		}
+	}
+}
+
+func TestOptContourOrderRemapsDiagnostics(t *testing.T) {
+	src := "G21G90\nT1M6\nG0Z5\n" + square(0, 0) + square(100, 0) + "T1M6\nG0X10Y0\nG1F100Z-1\nG3X20Y0I5J0\nG0Z5\n"
+	m := process(t, src)
+	if err := OptContourOrder(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Arcs) != 1 {
+		t.Fatalf("expected the arc to be kept, got %d arcs", len(m.Arcs))
+	}
+	a := m.Arcs[0]
+	start, end := m.Positions[a.Index], m.Positions[a.End]
+	if math.Hypot(start.X-10, start.Y) > 1e-9 || math.Hypot(end.X-20, end.Y) > 1e-9 {
+		t.Errorf("arc does not point at its end points: %v, %v", start.Vector(), end.Vector())
+	}
+	for idx, pos := range m.Positions[:a.End] {
+		if pos.X == 100 {
+			t.Errorf("expected the arc to be moved before the contour at X100, found it at %d", idx)
+			break
+		}
+	}
+
+	c := m.CheckRedundantToolChange()
+	if len(c) != 1 {
+		t.Fatalf("expected 1 redundant tool change, got %v", c)
+	}
+	if p := m.Positions[c[0]]; p.X != 10 || p.Y != 0 || p.Z != -1 {
+		t.Errorf("expected the change before the plunge at X10, got %v", p.Vector())
+	}
+}
@@ -8,18 +8,20 @@ import "github.com/kennylevinsen/gocnc/vector"
 // logs its height, and ensures that any future move at that location will use
 // vm.MoveModeRapid to go to the deepest previous known Z-height.
 func OptDrillSpeed(machine *vm.Machine, feedrate float64, rapid bool) {
+	machine.Record("OptDrillSpeed", feedrate, rapid)
 	var (
 		last       vector.Vector
 		npos       []vm.Position = make([]vm.Position, 0)
 		drillStack []vm.Position = make([]vm.Position, 0)
+		origins    []int         = make([]int, 0)
 	)
 
 	fastDrill := func(pos vm.Position) (vm.Position, vm.Position, bool) {
 		var depth float64
 		var found bool
 		for _, m := range drillStack {
-			if m.X == pos.X && m.Y == pos.Y {
-				if m.Z < depth {
+			if near(m.X, pos.X) && near(m.Y, pos.Y) {
+				if m.Z < depth-epsilon {
 					depth = m.Z
 					found = true
 				}
@@ -29,7 +31,7 @@ func OptDrillSpeed(machine *vm.Machine, feedrate float64, rapid bool) {
 		drillStack = append(drillStack, pos)
 
 		if found {
-			if pos.Z >= depth { // We have drilled all of it, so just rapid all the way
+			if pos.Z >= depth-epsilon { // We have drilled all of it, so just rapid all the way
 				if rapid {
 					pos.State.MoveMode = vm.MoveModeRapid
 				} else {
@@ -52,17 +54,19 @@ func OptDrillSpeed(machine *vm.Machine, feedrate float64, rapid bool) {
 		}
 	}
 
-	for _, m := range machine.Positions {
-		if m.X == last.X && m.Y == last.Y && m.Z < last.Z && m.State.MoveMode == vm.MoveModeLinear {
+	for idx, m := range machine.Positions {
+		if near(m.X, last.X) && near(m.Y, last.Y) && m.Z < last.Z-epsilon && m.State.MoveMode == vm.MoveModeLinear {
 			posn, poso, shouldinsert := fastDrill(m)
 			if shouldinsert {
 				npos = append(npos, posn)
+				origins = append(origins, -1)
 			}
 			npos = append(npos, poso)
 		} else {
 			npos = append(npos, m)
 		}
+		origins = append(origins, idx)
 		last = m.Vector()
 	}
-	machine.Positions = npos
+	setPositions(machine, npos, origins)
 }
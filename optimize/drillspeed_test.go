@@ -0,0 +1,26 @@
+package optimize
+
+import "testing"
+import "github.com/kennylevinsen/gocnc/vm"
+
+func TestOptDrillSpeedEpsilon(t *testing.T) {
+	m := process(t, "G21G90\nG0X10Y10Z5\nG1F50Z-5\nG0Z5\nG0X10.0000000001Y10\nG1F50Z-10\nG0Z5\n")
+	OptDrillSpeed(m, 500, true)
+
+	var plunge []vm.Position
+	for idx := 1; idx < len(m.Positions); idx++ {
+		pos := m.Positions[idx]
+		if pos.Z < m.Positions[idx-1].Z && pos.X != 10 {
+			plunge = append(plunge, pos)
+		}
+	}
+	if len(plunge) != 2 {
+		t.Fatalf("expected the second drill to be split in two, got %d moves", len(plunge))
+	}
+	if plunge[0].Z != -5 || plunge[0].State.MoveMode != vm.MoveModeRapid {
+		t.Errorf("expected a rapid to Z-5, got %v with mode %d", plunge[0].Vector(), plunge[0].State.MoveMode)
+	}
+	if plunge[1].Z != -10 || plunge[1].State.MoveMode != vm.MoveModeLinear {
+		t.Errorf("expected a feed to Z-10, got %v with mode %d", plunge[1].Vector(), plunge[1].State.MoveMode)
+	}
+}
@@ -11,29 +11,41 @@ import "github.com/kennylevinsen/gocnc/vm"
 // remaining position is paired up with the next position. This process
 // repeats until there are no positions left.
 func OptFloatingZ(machine *vm.Machine, minDistOverZ float64) {
+	machine.Record("OptFloatingZ", minDistOverZ)
 	mp := machine.Positions
 	if len(mp) == 0 {
 		return
 	}
 
 	npos := []vm.Position{mp[0]}
+	origins := []int{0}
 	for i := 1; i < len(mp); i++ {
 		// We always append for the last position
 		if i == len(mp)-1 {
 			npos = append(npos, mp[i])
+			origins = append(origins, i)
+			continue
+		}
+
+		// Non-moves must be kept in place
+		if !isMove(mp[i]) || !isMove(npos[len(npos)-1]) {
+			npos = append(npos, mp[i])
+			origins = append(origins, i)
 			continue
 		}
 
 		// This movement touches the material, skip 2 ahead.
 		if !(mp[i].Z > minDistOverZ && npos[len(npos)-1].Z > minDistOverZ) {
 			npos = append(npos, mp[i], mp[i+1])
+			origins = append(origins, i, i+1)
 			i++
 			continue
 		}
 
 		mp[i].State.MoveMode = vm.MoveModeRapid
 		npos[len(npos)-1] = mp[i]
+		origins[len(origins)-1] = i
 	}
 
-	machine.Positions = npos
+	setPositions(machine, npos, origins)
 }
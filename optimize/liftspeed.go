@@ -7,9 +7,10 @@ import "github.com/kennylevinsen/gocnc/vector"
 // Scans all positions for moves that only change the z-axis in a positive direction,
 // and sets the moveMode to vm.MoveModeRapid.
 func OptLiftSpeed(machine *vm.Machine) {
+	machine.Record("OptLiftSpeed")
 	var last vector.Vector
 	for idx, m := range machine.Positions {
-		if m.X == last.X && m.Y == last.Y && m.Z > last.Z {
+		if m.X == last.X && m.Y == last.Y && m.Z > last.Z && isMove(m) {
 			// We got a lift! Let's make it faster, shall we?
 			machine.Positions[idx].State.MoveMode = vm.MoveModeRapid
 		}
@@ -0,0 +1,124 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+
+import "errors"
+
+// An operation being moved around by a reordering pass
+type pass struct {
+	positions   []vm.Position // Starting with the plunge
+	origins     []int         // Original index of every position
+	approach    vm.Position   // Position to descend to before plunging
+	hasApproach bool
+}
+
+// Finds the operations of the machine, and validates that they can be reordered.
+// Returns the operations along with the safety height to travel at.
+func reorderableOperations(machine *vm.Machine) ([]vm.Operation, float64, error) {
+	mp := machine.Positions
+	ops := machine.Operations()
+	if len(ops) == 0 {
+		return ops, 0, nil
+	}
+
+	safetyHeight := machine.FindSafetyHeight()
+	if machine.InStock(safetyHeight) {
+		return nil, 0, errors.New("Unable to detect safety height")
+	}
+
+	first, last := ops[0], ops[len(ops)-1]
+	if first.Start == 0 {
+		return nil, 0, errors.New("Program starts below stock top")
+	}
+
+	for idx := first.Start; idx < last.End; idx++ {
+		if mp[idx].State.ToolIndex != mp[first.Start].State.ToolIndex {
+			return nil, 0, errors.New("Tool change between operations detected")
+		}
+	}
+
+	for idx := 1; idx < len(ops); idx++ {
+		for idy := ops[idx-1].End; idy < ops[idx].Start; idy++ {
+			if !isMove(mp[idy]) {
+				return nil, 0, errors.New("Non-move between operations detected")
+			}
+		}
+	}
+
+	return ops, safetyHeight, nil
+}
+
+// Extracts the positions of every operation, along with their approach if it was vertical.
+func extractPasses(machine *vm.Machine, ops []vm.Operation, safetyHeight float64) []pass {
+	mp := machine.Positions
+	res := make([]pass, len(ops))
+	for idx, op := range ops {
+		a, p := mp[op.Start-1], mp[op.Start]
+		origins := make([]int, op.End-op.Start)
+		for i := range origins {
+			origins[i] = op.Start + i
+		}
+		res[idx] = pass{
+			positions:   mp[op.Start:op.End],
+			origins:     origins,
+			approach:    a,
+			hasApproach: a.X == p.X && a.Y == p.Y && a.Z < safetyHeight,
+		}
+	}
+	return res
+}
+
+// Replaces the operations of the machine with the given passes, in order.
+// Travel between passes is done at safety height, descending to the approach height before
+// plunging. Positions before the first and after the last operation are kept.
+func rebuildPasses(machine *vm.Machine, ops []vm.Operation, passes []pass, safetyHeight float64) {
+	mp := machine.Positions
+	first, last := ops[0], ops[len(ops)-1]
+
+	newPos := make([]vm.Position, 0, len(mp))
+	origins := make([]int, 0, len(mp))
+	add := func(pos vm.Position, origin int) {
+		newPos = append(newPos, pos)
+		origins = append(origins, origin)
+	}
+	for idx := 0; idx < first.Start; idx++ {
+		add(mp[idx], idx)
+	}
+
+	retract := func() {
+		step1 := newPos[len(newPos)-1]
+		step1.Z = safetyHeight
+		step1.State.MoveMode = vm.MoveModeRapid
+		add(step1, -1)
+	}
+
+	for idx, p := range passes {
+		start := p.positions[0]
+		if idx != 0 || start.Vector() != mp[first.Start].Vector() {
+			retract()
+			step2 := newPos[len(newPos)-1]
+			step2.X, step2.Y = start.X, start.Y
+			add(step2, -1)
+			if p.hasApproach {
+				a := p.approach
+				a.State.MoveMode = vm.MoveModeRapid
+				add(a, -1)
+			}
+		}
+		for i, pos := range p.positions {
+			add(pos, p.origins[i])
+		}
+	}
+
+	// Skip the original final retract, continuing from safety height instead
+	rest := last.End
+	for rest < len(mp) && mp[rest].X == mp[last.End-1].X && mp[rest].Y == mp[last.End-1].Y && mp[rest].Z <= safetyHeight {
+		rest++
+	}
+	retract()
+	for idx := rest; idx < len(mp); idx++ {
+		add(mp[idx], idx)
+	}
+
+	setPositions(machine, newPos, origins)
+}
@@ -5,6 +5,8 @@ import "github.com/kennylevinsen/gocnc/vector"
 
 import "errors"
 import "fmt"
+import "math"
+import "sort"
 
 // Reduces moves between paths.
 // It does this by scanning through position stack, grouping moves that move from >= Z0 to < Z0.
@@ -13,15 +15,38 @@ import "fmt"
 // This optimization pass bails if the Z axis is moved simultaneously with any other axis,
 // or the input ends with the drill below Z0, in order to play it safe.
 // This pass is new, and therefore slightly experimental.
-func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
+func OptPathGrouping(machine *vm.Machine, tolerance float64) error {
+	if err := optPathGrouping(machine, tolerance, 0, 0); err != nil {
+		return err
+	}
+	machine.Record("OptPathGrouping", tolerance)
+	return nil
+}
+
+// Reduces moves between paths like OptPathGrouping, but travels between nearby groups at a
+// reduced height. If the gap to the next group is below clearanceGap and the two groups are at
+// similar depths, the tool is only lifted to clearance above the higher of the two depths,
+// instead of going all the way to safety height. If that is below Z0, the travel must pass over
+// moves already cut to that height or below, within tolerance.
+func OptPathGroupingClearance(machine *vm.Machine, tolerance, clearanceGap, clearance float64) error {
+	if err := optPathGrouping(machine, tolerance, clearanceGap, clearance); err != nil {
+		return err
+	}
+	machine.Record("OptPathGroupingClearance", tolerance, clearanceGap, clearance)
+	return nil
+}
+
+func optPathGrouping(machine *vm.Machine, tolerance, clearanceGap, clearance float64) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = errors.New(fmt.Sprintf("%s", r))
 		}
 	}()
 
-	type Set []vm.Position
+	// Indexes of the positions of a group
+	type Set []int
 	var (
+		mp                  []vm.Position = machine.Positions
 		lastx, lasty, lastz float64
 		sets                []Set = make([]Set, 0)
 		curSet              Set   = make(Set, 0)
@@ -31,7 +56,15 @@ func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
 	)
 
 	// Find grouped drills
-	for _, m := range machine.Positions {
+	for i, m := range mp {
+		if m.State.MoveMode == vm.MoveModeOrient {
+			panic("Spindle orientation detected")
+		}
+
+		if m.State.MoveMode == vm.MoveModeProbe {
+			panic("Probe detected")
+		}
+
 		if m.Z != lastz && (m.X != lastx || m.Y != lasty) {
 			panic("Complex z-motion detected")
 		}
@@ -70,7 +103,7 @@ func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
 			if m.Z > 0 {
 				panic("Move above stock detected")
 			}
-			curSet = append(curSet, m)
+			curSet = append(curSet, i)
 		}
 
 	updateLast:
@@ -88,7 +121,7 @@ func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
 
 	// If there was a final set without a proper lift
 	if len(curSet) == 1 {
-		p := curSet[0]
+		p := mp[curSet[0]]
 		if p.Z != safetyHeight || lastz != safetyHeight || p.X != 0 || p.Y != 0 {
 			panic("Incomplete final drill set")
 		}
@@ -99,7 +132,7 @@ func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
 	var (
 		curVec      vector.Vector
 		sortedSets  []Set = make([]Set, 0)
-		selectedSet int
+		selectedSet int   = -1
 	)
 
 	// Stupid difference calculator
@@ -109,37 +142,55 @@ func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
 		return j.Norm()
 	}
 
-	// Sort the sets after distance from current position
+	// Sort the sets after distance from current position.
+	// Equal distances prefer the higher set, and then the earlier set, to keep the order stable.
 	for len(sets) > 0 {
 		for idx := range sets {
 			if selectedSet == -1 {
 				selectedSet = idx
 			} else {
-				np := sets[idx][0]
-				pp := sets[selectedSet][0]
+				np := mp[sets[idx][0]]
+				pp := mp[sets[selectedSet][0]]
 				diff := xyDiff(np.Vector(), curVec)
 				other := xyDiff(pp.Vector(), curVec)
-				if diff < other {
+				if diff < other-epsilon {
 					selectedSet = idx
-				} else if np.Z > pp.Z {
+				} else if near(diff, other) && np.Z > pp.Z {
 					selectedSet = idx
 				}
 			}
 		}
-		curVec = sets[selectedSet][0].Vector()
+		curVec = mp[sets[selectedSet][0]].Vector()
 		sortedSets = append(sortedSets, sets[selectedSet])
 		sets = append(sets[0:selectedSet], sets[selectedSet+1:]...)
 		selectedSet = -1
 	}
 
 	// Reconstruct new position stack from sorted sections
-	newPos := []vm.Position{machine.Positions[0]} // Origin
+	newPos := []vm.Position{mp[0]} // Origin
+	origins := []int{0}
 
-	addPos := func(pos vm.Position) {
+	addPos := func(pos vm.Position, origin int) {
 		newPos = append(newPos, pos)
+		origins = append(origins, origin)
 	}
 
-	moveTo := func(pos vm.Position) {
+	// Finds the reduced height to travel from cur to next at, if any
+	travelHeight := func(cur, next vm.Position) (float64, bool) {
+		if clearance <= 0 || xyDiff(cur.Vector(), next.Vector()) >= clearanceGap || math.Abs(cur.Z-next.Z) > clearance {
+			return 0, false
+		}
+		h := math.Max(cur.Z, next.Z) + clearance
+		if h >= safetyHeight {
+			return 0, false
+		} else if h >= 0 {
+			// Above the stock
+			return h, true
+		}
+		return h, travelCleared(newPos, cur, next, h, tolerance)
+	}
+
+	moveTo := func(pos vm.Position, origin int) {
 		curPos := newPos[len(newPos)-1]
 
 		// Check if we should go to safety-height before moving
@@ -150,12 +201,16 @@ func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
 				step1.State.MoveMode = vm.MoveModeLinear
 				step1.X = pos.X
 				step1.Y = pos.Y
-				addPos(step1)
+				addPos(step1, -1)
 			}
-			addPos(pos)
+			addPos(pos, origin)
 		} else {
 			step1 := curPos
 			step1.Z = safetyHeight
+			if h, ok := travelHeight(curPos, pos); ok {
+				// Next group is close by, so just clear the stock
+				step1.Z = h
+			}
 			step1.State.MoveMode = vm.MoveModeRapid
 			step2 := step1
 			step2.X, step2.Y = pos.X, pos.Y
@@ -164,24 +219,125 @@ func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
 			step3.State.MoveMode = vm.MoveModeLinear
 			step3.State.Feedrate = drillSpeed
 
-			addPos(step1)
-			addPos(step2)
-			addPos(step3)
+			addPos(step1, -1)
+			addPos(step2, -1)
+			addPos(step3, origin)
 		}
 
 	}
 
 	for _, m := range sortedSets {
-		for idx, p := range m {
+		for idx, i := range m {
 			if idx == 0 {
-				moveTo(p)
+				moveTo(mp[i], i)
 			} else {
-				addPos(p)
+				addPos(mp[i], i)
 			}
 		}
 	}
 
-	machine.Positions = newPos
+	setPositions(machine, newPos, origins)
 
 	return nil
 }
+
+// Reports whether the straight travel from a to b at height h only passes over linear moves of
+// path that were cut at h or below, within tolerance.
+func travelCleared(path []vm.Position, a, b vm.Position, h, tolerance float64) bool {
+	flat := func(p vm.Position) vector.Vector {
+		return vector.Vector{p.X, p.Y, 0}
+	}
+
+	var (
+		covered    [][2]float64
+		minX, maxX float64 = math.Min(a.X, b.X) - tolerance, math.Max(a.X, b.X) + tolerance
+		minY, maxY float64 = math.Min(a.Y, b.Y) - tolerance, math.Max(a.Y, b.Y) + tolerance
+	)
+	for idx := 1; idx < len(path); idx++ {
+		p, q := path[idx-1], path[idx]
+		if q.State.MoveMode != vm.MoveModeLinear || p.Z > h || q.Z > h {
+			continue
+		}
+		if math.Max(p.X, q.X) < minX || math.Min(p.X, q.X) > maxX || math.Max(p.Y, q.Y) < minY || math.Min(p.Y, q.Y) > maxY {
+			// Too far away to cover any of the travel
+			continue
+		}
+		if lo, hi, ok := coveredInterval(flat(a), flat(b), flat(p), flat(q), tolerance); ok {
+			covered = append(covered, [2]float64{lo, hi})
+		}
+	}
+
+	sort.Slice(covered, func(i, j int) bool {
+		return covered[i][0] < covered[j][0]
+	})
+	reach := 0.0
+	for _, c := range covered {
+		if c[0] > reach+epsilon {
+			return false
+		}
+		reach = math.Max(reach, c[1])
+	}
+	return reach >= 1-epsilon
+}
+
+// Finds the interval of t in [0, 1] for which a + t*(b-a) lies within tolerance of the segment
+// from c to d, in the XY plane. The points within tolerance of the segment form a band along it,
+// capped by a disk at either end. Each of these cuts an interval out of the line, and as their
+// union is convex, the covered interval spans all of them.
+func coveredInterval(a, b, c, d vector.Vector, tolerance float64) (float64, float64, bool) {
+	var (
+		ux, uy float64 = b.X - a.X, b.Y - a.Y
+		lo, hi float64 = math.Inf(1), math.Inf(-1)
+	)
+	span := func(l, h float64) {
+		if l <= h {
+			lo, hi = math.Min(lo, l), math.Max(hi, h)
+		}
+	}
+
+	// Disks around the ends, where |a + t*u - p|^2 <= tolerance^2
+	disk := func(p vector.Vector) {
+		wx, wy := a.X-p.X, a.Y-p.Y
+		qa, qb, qc := ux*ux+uy*uy, 2*(ux*wx+uy*wy), wx*wx+wy*wy-tolerance*tolerance
+		if qa == 0 {
+			if qc <= 0 {
+				span(math.Inf(-1), math.Inf(1))
+			}
+			return
+		}
+		if disc := qb*qb - 4*qa*qc; disc >= 0 {
+			r := math.Sqrt(disc)
+			span((-qb-r)/(2*qa), (-qb+r)/(2*qa))
+		}
+	}
+	disk(c)
+	disk(d)
+
+	// The band, where the position along the segment and the distance across it are both linear
+	// in t
+	vx, vy := d.X-c.X, d.Y-c.Y
+	if l := math.Hypot(vx, vy); l > 0 {
+		wx, wy := a.X-c.X, a.Y-c.Y
+		bl, bh := math.Inf(-1), math.Inf(1)
+		within := func(k, m, min, max float64) {
+			// min <= k + m*t <= max
+			if m == 0 {
+				if k < min || k > max {
+					bl, bh = 1, 0
+				}
+				return
+			}
+			t1, t2 := (min-k)/m, (max-k)/m
+			bl, bh = math.Max(bl, math.Min(t1, t2)), math.Min(bh, math.Max(t1, t2))
+		}
+		within((wx*vx+wy*vy)/l, (ux*vx+uy*vy)/l, 0, l)
+		within((vx*wy-vy*wx)/l, (vx*uy-vy*ux)/l, -tolerance, tolerance)
+		span(bl, bh)
+	}
+
+	lo, hi = math.Max(lo, 0), math.Min(hi, 1)
+	if lo > hi {
+		return 0, 0, false
+	}
+	return lo, hi, true
+}
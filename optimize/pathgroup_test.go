@@ -0,0 +1,144 @@
+package optimize
+
+import "math"
+import "testing"
+import "github.com/kennylevinsen/gocnc/vector"
+import "github.com/kennylevinsen/gocnc/vm"
+
+// Heights of the rapid moves of the machine
+func rapidHeights(m *vm.Machine) []float64 {
+	var res []float64
+	for _, pos := range m.Positions {
+		if pos.State.MoveMode == vm.MoveModeRapid {
+			res = append(res, pos.Z)
+		}
+	}
+	return res
+}
+
+// Height of the travel to the group starting at X x, Y y
+func travelTo(t *testing.T, m *vm.Machine, x, y float64) float64 {
+	for _, pos := range m.Positions {
+		if pos.State.MoveMode == vm.MoveModeRapid && pos.X == x && pos.Y == y {
+			return pos.Z
+		}
+	}
+	t.Fatalf("no travel to X%v Y%v", x, y)
+	return 0
+}
+
+func TestOptPathGroupingClearance(t *testing.T) {
+	src := "G21G90\nG0Z5\nG0X0Y0\nG1F50Z-1\nG1F100X5\nG0Z5\nG0X6Y0\nG1F50Z-1\nG1F100X10\nG0Z5\nG0X0Y0\n"
+
+	m := process(t, src)
+	if err := OptPathGrouping(m, 0.001); err != nil {
+		t.Fatal(err)
+	}
+	if h := travelTo(t, m, 6, 0); h != 5 {
+		t.Errorf("expected travel at safety height, got %f", h)
+	}
+
+	// Clearance is relative to the depth of the groups
+	m = process(t, src)
+	if err := OptPathGroupingClearance(m, 0.001, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if h := travelTo(t, m, 6, 0); h != 0 {
+		t.Errorf("expected travel at Z0, got %f", h)
+	}
+
+	// Groups too far apart in depth
+	m = process(t, "G21G90\nG0Z5\nG0X0Y0\nG1F50Z-1\nG1F100X5\nG0Z5\nG0X6Y0\nG1F50Z-3\nG1F100X10\nG0Z5\nG0X0Y0\n")
+	if err := OptPathGroupingClearance(m, 0.001, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if h := travelTo(t, m, 6, 0); h != 5 {
+		t.Errorf("expected travel at safety height, got %f", h)
+	}
+}
+
+func TestOptPathGroupingClearanceInStock(t *testing.T) {
+	// The second group revisits the first slot, so travel can stay within it
+	src := "G21G90\nG0Z5\nG0X0Y0\nG1F50Z-1\nG1F100X10\nX0\nG0Z5\nG0X3Y0\nG1F50Z-1.2\nG1F100X7\nG0Z5\nG0X0Y0\n"
+	m := process(t, src)
+	if err := OptPathGroupingClearance(m, 0.001, 4, 0.5); err != nil {
+		t.Fatal(err)
+	}
+	if h := travelTo(t, m, 3, 0); h != -0.5 {
+		t.Errorf("expected travel at Z-0.5, got %f (rapids at %v)", h, rapidHeights(m))
+	}
+
+	// Travel over uncut stock
+	src = "G21G90\nG0Z5\nG0X0Y0\nG1F50Z-1\nG1F100X10\nX0\nG0Z5\nG0X3Y2\nG1F50Z-1.2\nG1F100X7\nG0Z5\nG0X0Y0\n"
+	m = process(t, src)
+	if err := OptPathGroupingClearance(m, 0.001, 4, 0.5); err != nil {
+		t.Fatal(err)
+	}
+	if h := travelTo(t, m, 3, 2); h != 5 {
+		t.Errorf("expected travel at safety height, got %f", h)
+	}
+}
+
+func TestOptPathGroupingDeterministic(t *testing.T) {
+	// All groups start at the same distance from the origin
+	src := "G21G90\nG0Z5\nG0X0Y10\nG1F50Z-1\nG1F100X1\nG0Z5\n" +
+		"G0X10Y0\nG1F50Z-1\nG1F100X11\nG0Z5\n" +
+		"G0X-10Y0\nG1F50Z-1\nG1F100X-9\nG0Z5\n"
+
+	a := process(t, src)
+	if err := OptPathGrouping(a, 0.001); err != nil {
+		t.Fatal(err)
+	}
+	b := process(t, src)
+	if err := OptPathGrouping(b, 0.001); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(a.Positions) != len(b.Positions) {
+		t.Fatalf("expected identical runs, got %d and %d positions", len(a.Positions), len(b.Positions))
+	}
+	for idx := range a.Positions {
+		if a.Positions[idx] != b.Positions[idx] {
+			t.Errorf("position %d: %+v differs from %+v", idx, a.Positions[idx], b.Positions[idx])
+		}
+	}
+
+	// Ties go to the earlier group
+	for _, pos := range a.Positions {
+		if pos.State.MoveMode == vm.MoveModeLinear {
+			if pos.X != 0 || pos.Y != 10 {
+				t.Errorf("expected the first group to be visited first, got X%v Y%v", pos.X, pos.Y)
+			}
+			break
+		}
+	}
+}
+
+func TestCoveredInterval(t *testing.T) {
+	a, b := vector.Vector{0, 0, 0}, vector.Vector{10, 0, 0}
+	cases := []struct {
+		c, d      vector.Vector
+		tolerance float64
+		lo, hi    float64
+		ok        bool
+	}{
+		// Parallel, at exactly the tolerance
+		{vector.Vector{2, 1, 0}, vector.Vector{5, 1, 0}, 1, 0.2, 0.5, true},
+		// Parallel and closer, so the disks at the ends reach further
+		{vector.Vector{2, 1, 0}, vector.Vector{5, 1, 0}, 2, (2 - math.Sqrt(3)) / 10, (5 + math.Sqrt(3)) / 10, true},
+		// Crossing
+		{vector.Vector{5, -3, 0}, vector.Vector{5, 3, 0}, 0.5, 0.45, 0.55, true},
+		// Beyond the end of the travel
+		{vector.Vector{8, 0, 0}, vector.Vector{20, 0, 0}, 0.1, 0.79, 1, true},
+		// A single point
+		{vector.Vector{3, 0.5, 0}, vector.Vector{3, 0.5, 0}, 1, (3 - math.Sqrt(0.75)) / 10, (3 + math.Sqrt(0.75)) / 10, true},
+		// Out of reach
+		{vector.Vector{2, 3, 0}, vector.Vector{5, 3, 0}, 1, 0, 0, false},
+	}
+	for idx, c := range cases {
+		lo, hi, ok := coveredInterval(a, b, c.c, c.d, c.tolerance)
+		if ok != c.ok || math.Abs(lo-c.lo) > 1e-9 || math.Abs(hi-c.hi) > 1e-9 {
+			t.Errorf("case %d: expected %f-%f (%t), got %f-%f (%t)", idx, c.lo, c.hi, c.ok, lo, hi, ok)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package optimize
 import "github.com/kennylevinsen/gocnc/vm"
 
 func OptPrepareTool(machine *vm.Machine) {
+	machine.Record("OptPrepareTool")
 	lastTool := -1
 	lastToolIdx := 0
 	mp := machine.Positions
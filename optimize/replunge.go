@@ -0,0 +1,49 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+
+import "math"
+
+// Removes retracts that plunge straight back down.
+// A cutting move followed by moves at the same XY (within tolerance), that rise and then return
+// to the same depth, wastes a retract and a plunge, so the moves in between are removed.
+// Anything but plain moves act as barriers.
+func OptRemoveRedundantReplunge(machine *vm.Machine, tolerance float64) {
+	machine.Record("OptRemoveRedundantReplunge", tolerance)
+	var (
+		mp      []vm.Position = machine.Positions
+		npos    []vm.Position = make([]vm.Position, 0, len(mp))
+		origins []int         = make([]int, 0, len(mp))
+	)
+
+	for idx := 0; idx < len(mp); idx++ {
+		pos := mp[idx]
+		npos = append(npos, pos)
+		origins = append(origins, idx)
+		if !isMove(pos) || !machine.InStock(pos.Z) {
+			continue
+		}
+
+		// Find the last return to this depth among the following moves at this XY
+		var (
+			end    int = -1
+			raised bool
+		)
+		for next := idx + 1; next < len(mp); next++ {
+			m := mp[next]
+			if !isMove(m) || math.Hypot(m.X-pos.X, m.Y-pos.Y) > tolerance {
+				break
+			}
+			if m.Z > pos.Z+tolerance {
+				raised = true
+			} else if raised && math.Abs(m.Z-pos.Z) <= tolerance {
+				end = next
+			}
+		}
+		if end != -1 {
+			idx = end
+		}
+	}
+
+	setPositions(machine, npos, origins)
+}
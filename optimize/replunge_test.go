@@ -0,0 +1,60 @@
+package optimize
+
+import "testing"
+import "github.com/kennylevinsen/gocnc/vm"
+
+func TestOptRemoveRedundantReplunge(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG1F100Z-1\nX10\nG0Z5\nG1Z-1\nX20\nG0Z5\nG0X30\nG1Z-1\nG0Z5\n")
+	OptRemoveRedundantReplunge(m, 0.001)
+
+	// The retract and plunge at X10 are gone, but not those around the move to X30
+	expected := []vm.Position{
+		{X: 0, Y: 0, Z: 5},
+		{X: 0, Y: 0, Z: -1},
+		{X: 10, Y: 0, Z: -1},
+		{X: 20, Y: 0, Z: -1},
+		{X: 20, Y: 0, Z: 5},
+		{X: 30, Y: 0, Z: 5},
+		{X: 30, Y: 0, Z: -1},
+		{X: 30, Y: 0, Z: 5},
+	}
+	var got []vm.Position
+	for _, pos := range m.Positions[1:] {
+		if pos.State.MoveMode != vm.MoveModeNone {
+			got = append(got, pos)
+		}
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d moves, got %d", len(expected), len(got))
+	}
+	for idx, e := range expected {
+		if got[idx].Vector() != e.Vector() {
+			t.Errorf("move %d: expected %v, got %v", idx, e.Vector(), got[idx].Vector())
+		}
+	}
+	if got[3].State.MoveMode != vm.MoveModeLinear {
+		t.Errorf("expected the cut to X20 to stay a feed move")
+	}
+}
+
+func TestOptRemoveRedundantReplungeDiagnostics(t *testing.T) {
+	m := process(t, "G21G90\nT1M6\nG0Z5\nG1F100Z-1\nX10\nG0Z5\nT1M6\nG1Z-1\nX15\nG2X25Y0I5J0\nG0Z5\n")
+	before := m.Arcs[0]
+	OptRemoveRedundantReplunge(m, 0.001)
+
+	if len(m.Arcs) != 1 {
+		t.Fatalf("expected the arc to be kept, got %d arcs", len(m.Arcs))
+	}
+	if a := m.Arcs[0]; a.Index != before.Index-2 || a.End != before.End-2 {
+		t.Errorf("expected arc at %d-%d, got %d-%d", before.Index-2, before.End-2, a.Index, a.End)
+	}
+
+	// The change was before the removed plunge, so it moves to the cut after it
+	c := m.CheckRedundantToolChange()
+	if len(c) != 1 {
+		t.Fatalf("expected 1 redundant tool change, got %v", c)
+	}
+	if p := m.Positions[c[0]]; p.X != 15 || p.Z != -1 {
+		t.Errorf("expected the change before the cut to X15, got %v", p.Vector())
+	}
+}
@@ -0,0 +1,63 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/vector"
+
+import "math"
+
+// Tolerance used for coordinate comparisons
+const epsilon = 1e-9
+
+// Tests if the position is a regular move, as opposed to dwells and other markers,
+// which act as optimization barriers.
+func isMove(pos vm.Position) bool {
+	return pos.State.MoveMode == vm.MoveModeRapid || pos.State.MoveMode == vm.MoveModeLinear
+}
+
+// Tests if two coordinates are equal within epsilon
+func near(a, b float64) bool {
+	return math.Abs(a-b) <= epsilon
+}
+
+// Distance from p to the line segment from a to b
+func segmentDistance(a, b, p vector.Vector) float64 {
+	d := b.Diff(a)
+	l := d.Dot(d)
+	if l == 0 {
+		return p.Diff(a).Norm()
+	}
+	t := math.Max(0, math.Min(1, p.Diff(a).Dot(d)/l))
+	return p.Diff(vector.Vector{a.X + d.X*t, a.Y + d.Y*t, a.Z + d.Z*t}).Norm()
+}
+
+// Replaces the positions of the machine, updating its diagnostics.
+// origins holds the index of the original position every new position was taken from, or -1
+// for positions that were added. Removed positions that were merged into an identical neighbour
+// within epsilon are mapped to it.
+func setPositions(machine *vm.Machine, npos []vm.Position, origins []int) {
+	mp := machine.Positions
+	remap := make([]int, len(mp))
+	for idx := range remap {
+		remap[idx] = -1
+	}
+	for idx, o := range origins {
+		if o >= 0 && remap[o] == -1 {
+			remap[o] = idx
+		}
+	}
+	for idx := range remap {
+		if remap[idx] != -1 {
+			continue
+		}
+		same := func(n int) bool {
+			return n >= 0 && n < len(mp) && remap[n] != -1 && npos[remap[n]].Vector().Diff(mp[idx].Vector()).Norm() <= epsilon
+		}
+		if same(idx + 1) {
+			remap[idx] = remap[idx+1]
+		} else if same(idx - 1) {
+			remap[idx] = remap[idx-1]
+		}
+	}
+	machine.Positions = npos
+	machine.RemapDiagnostics(remap)
+}
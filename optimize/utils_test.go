@@ -0,0 +1,124 @@
+package optimize
+
+import "testing"
+import "github.com/kennylevinsen/gocnc/gcode"
+import "github.com/kennylevinsen/gocnc/vm"
+
+// Parses and processes src on a fresh machine
+func process(t *testing.T, src string) *vm.Machine {
+	doc, err := gcode.Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m vm.Machine
+	m.Init()
+	if err := m.Process(doc); err != nil {
+		t.Fatal(err)
+	}
+	return &m
+}
+
+func TestOptVectorRemapsArcs(t *testing.T) {
+	m := process(t, "G21G90\nG1F100X1Y0\nX2\nX10\nG3X0Y10I-10J0\n")
+	before := m.Arcs[0]
+	OptVector(m, 1e-9, false)
+	if len(m.Arcs) != 1 {
+		t.Fatalf("expected the arc to be kept, got %d arcs", len(m.Arcs))
+	}
+	a := m.Arcs[0]
+	if a.Index != before.Index-2 {
+		t.Errorf("expected arc at %d, got %d", before.Index-2, a.Index)
+	}
+	if end := m.Positions[a.End]; end.X != 0 || end.Y != 10 {
+		t.Errorf("arc end does not point at the end point: %v", end.Vector())
+	}
+
+	// Merging the segments of the arc drops it
+	OptVector(m, 1, false)
+	if len(m.Arcs) != 0 {
+		t.Errorf("expected the arc to be dropped, got %v", m.Arcs)
+	}
+}
+
+func TestOrientBarrier(t *testing.T) {
+	src := "G21G90\nM3S1000\nG1F100X10\nX20\n"
+	plain := process(t, src)
+	m := process(t, "G21G90\nM3S1000\nG1F100X10\nM19\nX20\n")
+	for _, machine := range []*vm.Machine{plain, m} {
+		OptBogusMoves(machine)
+		OptVector(machine, 0.001, false)
+	}
+
+	orients := 0
+	for _, pos := range m.Positions {
+		if pos.State.MoveMode == vm.MoveModeOrient {
+			orients++
+			if pos.X != 10 {
+				t.Errorf("expected the orientation at X10, got %v", pos.Vector())
+			}
+		}
+	}
+	if orients != 1 {
+		t.Fatalf("expected the orientation to survive, got %d", orients)
+	}
+	if len(moves(plain)) != 1 {
+		t.Errorf("expected the moves without orientation to be merged, got %d", len(moves(plain)))
+	}
+	if m.ETA() <= plain.ETA() {
+		t.Errorf("expected the orientation to add to the ETA, got %s and %s", m.ETA(), plain.ETA())
+	}
+}
+
+func TestPassesRemapArcs(t *testing.T) {
+	src := "G21G90\nG0Z5\nX10Y0\nG1F100Z-1\nG0Z5\nG1Z-2\nG3X0Y10I-10J0\nG0Z5\nX0Y0\n"
+	passes := map[string]func(*vm.Machine){
+		"OptBogusMoves": OptBogusMoves,
+		"OptDrillSpeed": func(m *vm.Machine) { OptDrillSpeed(m, 1000, true) },
+		"OptFloatingZ":  func(m *vm.Machine) { OptFloatingZ(m, 1) },
+		"OptPathGrouping": func(m *vm.Machine) {
+			if err := OptPathGrouping(m, 0.1); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+	for name, pass := range passes {
+		m := process(t, src)
+		pass(m)
+		if len(m.Arcs) != 1 {
+			t.Errorf("%s: expected the arc to be kept, got %d arcs", name, len(m.Arcs))
+			continue
+		}
+		a := m.Arcs[0]
+		start, end := m.Positions[a.Index], m.Positions[a.End]
+		if start.X != 10 || start.Y != 0 || end.X != 0 || end.Y != 10 {
+			t.Errorf("%s: arc does not point at its end points: %v, %v", name, start.Vector(), end.Vector())
+		}
+	}
+}
+
+func TestPassesRemapToolChanges(t *testing.T) {
+	src := "G21G90\nT1M6\nG0Z5\nX10Y0\nG1F100Z-1\nG0Z5\nG1Z-2\nT1M6\nG1X20\nY10\nG0Z5\nX0Y0\n"
+	passes := map[string]func(*vm.Machine){
+		"OptBogusMoves": OptBogusMoves,
+		"OptDrillSpeed": func(m *vm.Machine) { OptDrillSpeed(m, 1000, true) },
+		"OptFloatingZ":  func(m *vm.Machine) { OptFloatingZ(m, 1) },
+		"OptVector":     func(m *vm.Machine) { OptVector(m, 1e-9, false) },
+		"OptPathGrouping": func(m *vm.Machine) {
+			if err := OptPathGrouping(m, 0.1); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+	for name, pass := range passes {
+		m := process(t, src)
+		pass(m)
+		c := m.CheckRedundantToolChange()
+		if len(c) != 1 {
+			t.Errorf("%s: expected 1 redundant tool change, got %v", name, c)
+			continue
+		}
+		if p := m.Positions[c[0]]; p.X != 20 || p.Y != 0 {
+			t.Errorf("%s: expected the change before X20, got %v", name, p.Vector())
+		}
+	}
+}
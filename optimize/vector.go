@@ -5,16 +5,29 @@ import "github.com/kennylevinsen/gocnc/vector"
 
 // Kills redundant partial moves.
 // Calculates the unit-vector, and kills all incremental moves between A and B.
-func OptVector(machine *vm.Machine, tolerance float64) {
+// The tolerance is the path length a merge may save. A tolerance of 0 uses the blend tolerance of
+// the program (G64 P) instead, which is a maximum deviation from the path: moves are then only
+// merged if none of the removed points are further than it from the merged move.
+// If mergeFeeds is set, moves with different feedrates are merged, keeping the last feedrate.
+func OptVector(machine *vm.Machine, tolerance float64, mergeFeeds bool) {
+	machine.Record("OptVector", tolerance, mergeFeeds)
+	deviation := tolerance == 0
+	if deviation {
+		tolerance = machine.BlendTolerance
+	}
+
 	var (
 		vec1, vec2, vec3 vector.Vector
+		dropped          []vector.Vector
 		ready            int
 		length1, length2 float64
 		lastMoveMode     int
+		lastFeedrate     float64
 		npos             []vm.Position = make([]vm.Position, 0)
+		origins          []int         = make([]int, 0)
 	)
 
-	for _, m := range machine.Positions {
+	for idx, m := range machine.Positions {
 		if m.State.MoveMode != vm.MoveModeLinear && m.State.MoveMode != vm.MoveModeRapid {
 			ready = 0
 			goto appendpos
@@ -25,6 +38,16 @@ func OptVector(machine *vm.Machine, tolerance float64) {
 			ready = 0
 		}
 
+		if !mergeFeeds && m.State.Feedrate != lastFeedrate && ready > 0 {
+			// Start over from this move, so that only moves with this feedrate are merged
+			lastFeedrate = m.State.Feedrate
+			vec1 = npos[len(npos)-1].Vector()
+			vec2 = m.Vector()
+			ready = 2
+			goto appendpos
+		}
+		lastFeedrate = m.State.Feedrate
+
 		if ready == 0 {
 			vec1 = m.Vector()
 			ready++
@@ -42,16 +65,33 @@ func OptVector(machine *vm.Machine, tolerance float64) {
 			vec3 = m.Vector()
 		}
 
-		length1 = vec1.Diff(vec2).Norm() + vec2.Diff(vec3).Norm()
-		length2 = vec1.Diff(vec3).Norm()
-		if length1-length2 < tolerance {
-			npos[len(npos)-1] = m
-			vec2 = vec1
-			continue
+		if deviation {
+			merge := segmentDistance(vec1, vec3, vec2) <= tolerance
+			for _, d := range dropped {
+				merge = merge && segmentDistance(vec1, vec3, d) <= tolerance
+			}
+			if merge {
+				dropped = append(dropped, vec2)
+				npos[len(npos)-1] = m
+				origins[len(origins)-1] = idx
+				vec2 = vec1
+				continue
+			}
+		} else {
+			length1 = vec1.Diff(vec2).Norm() + vec2.Diff(vec3).Norm()
+			length2 = vec1.Diff(vec3).Norm()
+			if length1-length2 < tolerance {
+				npos[len(npos)-1] = m
+				origins[len(origins)-1] = idx
+				vec2 = vec1
+				continue
+			}
 		}
 
 	appendpos:
+		dropped = dropped[:0]
 		npos = append(npos, m)
+		origins = append(origins, idx)
 	}
-	machine.Positions = npos
+	setPositions(machine, npos, origins)
 }
@@ -0,0 +1,91 @@
+package optimize
+
+import "testing"
+import "github.com/kennylevinsen/gocnc/vm"
+
+// Positions of linear moves, skipping the origin and null moves
+func moves(m *vm.Machine) []vm.Position {
+	var res []vm.Position
+	for _, pos := range m.Positions[1:] {
+		if pos.State.MoveMode != vm.MoveModeNone {
+			res = append(res, pos)
+		}
+	}
+	return res
+}
+
+// Checks that all points are within tolerance of the path
+func checkDeviation(t *testing.T, points, path []vm.Position, tolerance float64) {
+	for _, p := range points {
+		best := -1.0
+		for idx := 1; idx < len(path); idx++ {
+			d := segmentDistance(path[idx-1].Vector(), path[idx].Vector(), p.Vector())
+			if best < 0 || d < best {
+				best = d
+			}
+		}
+		if best > tolerance+1e-9 {
+			t.Errorf("point %v deviates by %f from the simplified path", p.Vector(), best)
+		}
+	}
+}
+
+func TestOptVectorBlendTolerance(t *testing.T) {
+	src := "G21G90G64P0.05\nG1F100X0Y0\nX10Y0.04\nX20Y0\nX30Y0.06\nX40Y0\nX50Y0.03\nX60Y0.06\nX70Y0.09\nX80Y0.12\n"
+
+	m := process(t, src)
+	points := moves(m)
+	OptVector(m, 0, false)
+	res := moves(m)
+	if len(res) >= len(points) {
+		t.Errorf("expected moves to be merged, got %d of %d", len(res), len(points))
+	}
+	checkDeviation(t, points, res, 0.05)
+
+	// Without G64 P, only straight runs are merged
+	m = process(t, "G21G90\nG1F100X0Y0\nX10Y0.04\nX20Y0\nX30Y0\nX40Y0\n")
+	OptVector(m, 0, false)
+	if res := moves(m); len(res) != 4 {
+		t.Errorf("expected 4 moves, got %d", len(res))
+	}
+}
+
+func TestOptVectorMergeFeeds(t *testing.T) {
+	src := "G21G90\nG1F100X1\nX10\nF200X20\n"
+	m := process(t, src)
+	OptVector(m, 0.001, false)
+	if res := moves(m); len(res) != 3 {
+		t.Errorf("expected the moves to stay separate, got %d", len(res))
+	}
+
+	m = process(t, src)
+	OptVector(m, 0.001, true)
+	res := moves(m)
+	if len(res) != 2 {
+		t.Fatalf("expected the moves to be merged, got %d", len(res))
+	}
+	if res[1].X != 20 || res[1].State.Feedrate != 200 {
+		t.Errorf("expected a move to X20 at F200, got %v at F%f", res[1].Vector(), res[1].State.Feedrate)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	m := process(t, "G21G90\nG1F100X1\nX2\nX3\n")
+	OptVector(m, 0.001, false)
+	m.RotateXY(90, 1, 2)
+	expected := []string{"OptVector(0.001, false)", "RotateXY(90, 1, 2)"}
+	h := m.History()
+	if len(h) != len(expected) {
+		t.Fatalf("expected history %v, got %v", expected, h)
+	}
+	for idx := range expected {
+		if h[idx] != expected[idx] {
+			t.Errorf("entry %d: expected %s, got %s", idx, expected[idx], h[idx])
+		}
+	}
+
+	h[0] = ""
+	if h := m.History(); h[0] != expected[0] {
+		t.Error("history of the machine was modified through the result")
+	}
+}
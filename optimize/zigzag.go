@@ -0,0 +1,67 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+
+import "errors"
+import "math"
+
+// Reverses every other pass of a raster, making the tool snake back and forth.
+// All operations must be parallel straight passes in the same direction, such as those of a
+// one-directional finishing raster. The cut geometry is kept, but the long return rapids
+// between passes are replaced by a short travel to the end of the next pass. The tool is still
+// retracted between passes, as feeding across at depth would cut the material between them.
+// This optimization pass bails under the same conditions as OptContourOrder.
+func OptZigZag(machine *vm.Machine) error {
+	ops, safetyHeight, err := reorderableOperations(machine)
+	if err != nil {
+		return err
+	} else if len(ops) < 2 {
+		return nil
+	}
+
+	passes := extractPasses(machine, ops, safetyHeight)
+
+	direction := func(p pass) (float64, float64) {
+		s, e := p.positions[0], p.positions[len(p.positions)-1]
+		return e.X - s.X, e.Y - s.Y
+	}
+
+	dx, dy := direction(passes[0])
+	for _, p := range passes {
+		x, y := direction(p)
+		l := math.Hypot(dx, dy) * math.Hypot(x, y)
+		if l == 0 || math.Abs(dx*y-dy*x)/l > 1e-6 || dx*x+dy*y <= 0 {
+			return errors.New("Operations are not parallel one-directional passes")
+		}
+	}
+
+	for idx := 1; idx < len(passes); idx += 2 {
+		passes[idx] = reversePass(passes[idx])
+	}
+
+	rebuildPasses(machine, ops, passes, safetyHeight)
+	machine.Record("OptZigZag")
+	return nil
+}
+
+// Reverses the direction of a pass. The state of every move is kept with the move, so each
+// point takes the state of the point after it in the original pass.
+func reversePass(p pass) pass {
+	n := len(p.positions)
+	res := make([]vm.Position, n)
+	origins := make([]int, n)
+	for idx := 0; idx < n; idx++ {
+		res[idx] = p.positions[n-1-idx]
+		origins[idx] = p.origins[n-1-idx]
+		if idx == 0 {
+			res[idx].State = p.positions[0].State
+		} else {
+			res[idx].State = p.positions[n-idx].State
+		}
+	}
+
+	p.approach.X, p.approach.Y = res[0].X, res[0].Y
+	p.positions = res
+	p.origins = origins
+	return p
+}
@@ -0,0 +1,93 @@
+package optimize
+
+import "fmt"
+import "math"
+import "testing"
+import "github.com/kennylevinsen/gocnc/vm"
+
+func TestOptZigZagReversesPasses(t *testing.T) {
+	src := "G21G90\nG0Z5\n"
+	for _, y := range []string{"0", "1", "2", "3"} {
+		src += "G0X0Y" + y + "\nG1F100Z-1\nG1X10F200\nG0Z5\n"
+	}
+	m := process(t, src)
+	if err := OptZigZag(m); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every other pass is reversed, and the tool retracts for the short travel between passes
+	expected := [][3]float64{{0, 10, 0}, {10, 0, 1}, {0, 10, 2}, {10, 0, 3}}
+	var cuts [][3]float64
+	for idx := 1; idx < len(m.Positions); idx++ {
+		a, b := m.Positions[idx-1], m.Positions[idx]
+		if a.X == b.X && a.Y == b.Y {
+			continue
+		}
+		switch {
+		case b.Z == -1 && a.Z == -1:
+			if b.State.MoveMode != vm.MoveModeLinear || a.Y != b.Y {
+				t.Errorf("position %d: expected a cut along X, got %v with mode %d", idx, b.Vector(), b.State.MoveMode)
+			}
+			cuts = append(cuts, [3]float64{a.X, b.X, b.Y})
+		case b.Z == 5 && a.Z == 5:
+			if b.State.MoveMode != vm.MoveModeRapid || math.Hypot(b.X-a.X, b.Y-a.Y) > 1 {
+				t.Errorf("position %d: expected a short rapid travel, got %v to %v", idx, a.Vector(), b.Vector())
+			}
+		default:
+			t.Errorf("position %d: unexpected move from %v to %v", idx, a.Vector(), b.Vector())
+		}
+	}
+	if len(cuts) != len(expected) {
+		t.Fatalf("expected cuts %v, got %v", expected, cuts)
+	}
+	for idx := range expected {
+		if cuts[idx] != expected[idx] {
+			t.Errorf("cut %d: expected %v, got %v", idx, expected[idx], cuts[idx])
+		}
+	}
+}
+
+func TestOptZigZagRetractsAcrossDepths(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG0X0Y0\nG1F100Z-1\nX10\nG0Z5\nG0X0Y1\nG1Z-2\nX10\nG0Z5\n")
+	if err := OptZigZag(m); err != nil {
+		t.Fatal(err)
+	}
+	retracted := false
+	for _, pos := range m.Positions {
+		if pos.State.MoveMode == vm.MoveModeRapid && pos.X == 10 && pos.Y == 1 {
+			retracted = true
+		}
+	}
+	if !retracted {
+		t.Error("expected a rapid to the start of the deeper pass")
+	}
+}
+
+func TestOptZigZagRemapsDiagnostics(t *testing.T) {
+	arc := func(y float64) string {
+		return fmt.Sprintf("G0X0Y%g\nG1F100Z-1\nG2X10Y%gI5J0\nG0Z5\n", y, y)
+	}
+	src := "G21G90\nT1M6\nG0Z5\n" + arc(0) + arc(5) + "T1M6\nG0X0Y10\nG1F100Z-1\nX10\nG0Z5\n"
+	m := process(t, src)
+	if err := OptZigZag(m); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reversed arc no longer matches its linearization
+	if len(m.Arcs) != 1 {
+		t.Fatalf("expected only the first arc to be kept, got %d arcs", len(m.Arcs))
+	}
+	a := m.Arcs[0]
+	start, end := m.Positions[a.Index], m.Positions[a.End]
+	if math.Hypot(start.X, start.Y) > 1e-9 || math.Hypot(end.X-10, end.Y) > 1e-9 {
+		t.Errorf("arc does not point at its end points: %v, %v", start.Vector(), end.Vector())
+	}
+
+	c := m.CheckRedundantToolChange()
+	if len(c) != 1 {
+		t.Fatalf("expected 1 redundant tool change, got %v", c)
+	}
+	if p := m.Positions[c[0]]; p.X != 0 || p.Y != 10 || p.Z != -1 {
+		t.Errorf("expected the change before the plunge of the last pass, got %v", p.Vector())
+	}
+}
@@ -0,0 +1,571 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/vector"
+
+import "math"
+import "sort"
+
+// A contiguous run of positions below the stock top, Positions[Start:End]
+type Operation struct {
+	Start, End int
+}
+
+// Splits the program into operations.
+// An operation starts with the move that plunges into the stock, and ends with the retract.
+// Positions that do not move, such as the origin, do not start an operation.
+func (vm *Machine) Operations() []Operation {
+	var (
+		res   []Operation
+		start int = -1
+	)
+	for idx, pos := range vm.Positions {
+		if vm.InStock(pos.Z) {
+			if start == -1 && pos.State.MoveMode != MoveModeNone {
+				start = idx
+			}
+		} else if start != -1 {
+			res = append(res, Operation{start, idx})
+			start = -1
+		}
+	}
+	if start != -1 {
+		res = append(res, Operation{start, len(vm.Positions)})
+	}
+	return res
+}
+
+// Tests if an operation is a closed contour, that is, ending within 1% of its XY path length of
+// where it started in XY.
+func (vm *Machine) closedContour(op Operation) bool {
+	var length float64
+	for idx := op.Start + 1; idx < op.End; idx++ {
+		a, b := vm.Positions[idx-1], vm.Positions[idx]
+		length += math.Hypot(b.X-a.X, b.Y-a.Y)
+	}
+	start, end := vm.Positions[op.Start], vm.Positions[op.End-1]
+	return length > 0 && math.Hypot(end.X-start.X, end.Y-start.Y) <= 0.01*length
+}
+
+// Finds the XY entry point of every closed contour, being where its operation plunges below the
+// stock top. Z is left at 0.
+func (vm *Machine) ContourEntryPoints() []vector.Vector {
+	var res []vector.Vector
+	for _, op := range vm.Operations() {
+		if vm.closedContour(op) {
+			pos := vm.Positions[op.Start]
+			res = append(res, vector.Vector{pos.X, pos.Y, 0})
+		}
+	}
+	return res
+}
+
+// Extents of an operation
+type OperationBox struct {
+	Op               int
+	MinX, MinY, MinZ float64
+	MaxX, MaxY, MaxZ float64
+}
+
+// Calculates the extents of every operation
+func (vm *Machine) OperationBounds() []OperationBox {
+	var res []OperationBox
+	for idx, op := range vm.Operations() {
+		b := OperationBox{Op: idx}
+		b.MinX, b.MinY, b.MinZ, b.MaxX, b.MaxY, b.MaxZ = extents(vm.Positions[op.Start:op.End])
+		res = append(res, b)
+	}
+	return res
+}
+
+// Estimate tool engagement angle (radians) for all cutting moves.
+// A lateral move running parallel to, and within a tool diameter of, an earlier pass at the
+// same Z is assumed to cut at the given stepover. Any other lateral cut is treated as a full slot.
+// The result is indexed like Positions, with 0 for non-cutting and pure Z moves.
+// Earlier passes are looked up in a grid of cells of at least one tool diameter, so only nearby
+// moves are compared.
+func (vm *Machine) EngagementEstimate(toolRadius, stepover float64) []float64 {
+	res := make([]float64, len(vm.Positions))
+	partial := math.Acos(1 - math.Min(stepover, 2*toolRadius)/toolRadius)
+
+	// Lateral cutting moves, by the index of their end position
+	lateral := func(idx int) bool {
+		pos, start := vm.Positions[idx], vm.Positions[idx-1]
+		return vm.cutting(pos) && math.Abs(pos.Z-start.Z) <= epsilon &&
+			math.Hypot(pos.X-start.X, pos.Y-start.Y) >= epsilon
+	}
+
+	// Cells are sized to the tool diameter, or the average move if longer, so that moves span
+	// few cells
+	var (
+		total float64
+		count int
+	)
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		if lateral(idx) {
+			a, b := vm.Positions[idx-1], vm.Positions[idx]
+			total += math.Hypot(b.X-a.X, b.Y-a.Y)
+			count++
+		}
+	}
+	if count == 0 {
+		return res
+	}
+	cell := math.Max(2*toolRadius, total/float64(count))
+
+	type key struct{ x, y int }
+	var (
+		grid map[key][]int = make(map[key][]int)
+		seen []int         = make([]int, len(vm.Positions))
+	)
+	cells := func(a, b Position, margin float64, f func(key)) {
+		x0, x1 := int(math.Floor((math.Min(a.X, b.X)-margin)/cell)), int(math.Floor((math.Max(a.X, b.X)+margin)/cell))
+		y0, y1 := int(math.Floor((math.Min(a.Y, b.Y)-margin)/cell)), int(math.Floor((math.Max(a.Y, b.Y)+margin)/cell))
+		for x := x0; x <= x1; x++ {
+			for y := y0; y <= y1; y++ {
+				f(key{x, y})
+			}
+		}
+	}
+
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		if !lateral(idx) {
+			continue
+		}
+		pos := vm.Positions[idx]
+		start := vm.Positions[idx-1]
+		dx, dy := pos.X-start.X, pos.Y-start.Y
+		length := math.Hypot(dx, dy)
+
+		res[idx] = math.Pi
+		cells(start, pos, 2*toolRadius+epsilon, func(k key) {
+			for _, idy := range grid[k] {
+				if res[idx] != math.Pi || seen[idy] == idx {
+					continue
+				}
+				seen[idy] = idx
+
+				b, a := vm.Positions[idy], vm.Positions[idy-1]
+				if math.Abs(b.Z-pos.Z) > epsilon {
+					continue
+				}
+
+				ox, oy := b.X-a.X, b.Y-a.Y
+				olength := math.Hypot(ox, oy)
+				if math.Abs(dx*oy-dy*ox) > epsilon*length*olength+epsilon {
+					// Not parallel
+					continue
+				}
+
+				// Distance between the two lines
+				dist := math.Abs(dx*(a.Y-start.Y)-dy*(a.X-start.X)) / length
+				if dist < epsilon || dist > 2*toolRadius+epsilon {
+					continue
+				}
+
+				// Overlap along the direction of the move
+				t1 := (dx*(a.X-start.X) + dy*(a.Y-start.Y)) / length
+				t2 := (dx*(b.X-start.X) + dy*(b.Y-start.Y)) / length
+				if math.Max(t1, t2) > epsilon && math.Min(t1, t2) < length-epsilon {
+					res[idx] = partial
+				}
+			}
+		})
+		cells(start, pos, 0, func(k key) {
+			grid[k] = append(grid[k], idx)
+		})
+	}
+	return res
+}
+
+// Splits the program into chunks of at most maxLines positions, for senders that stream in parts.
+// Chunks only end at a position at safety height, so the machine is retracted whenever a chunk
+// is done. If no such position is found within maxLines, the chunk grows until one is.
+// A maxLines <= 0 returns the entire program as one chunk.
+func (vm *Machine) Chunks(maxLines int) [][]Position {
+	if len(vm.Positions) == 0 {
+		return nil
+	} else if maxLines <= 0 {
+		return [][]Position{vm.Positions}
+	}
+
+	var (
+		res          [][]Position
+		start        int
+		safe         int     = -1
+		safetyHeight float64 = vm.FindSafetyHeight()
+	)
+	for idx, pos := range vm.Positions {
+		if idx-start >= maxLines && safe >= start {
+			res = append(res, vm.Positions[start:safe+1])
+			start = safe + 1
+		}
+		if pos.Z >= safetyHeight-epsilon {
+			safe = idx
+		}
+	}
+	return append(res, vm.Positions[start:])
+}
+
+// Calculates the convex hull of the XY footprint of all cutting moves.
+// Vertices are returned counterclockwise with Z set to 0, starting with the lowest X.
+func (vm *Machine) Footprint() []vector.Vector {
+	var points []vector.Vector
+	for idx, pos := range vm.Positions {
+		if idx == 0 || !vm.cutting(pos) {
+			continue
+		}
+		prev := vm.Positions[idx-1]
+		points = append(points, vector.Vector{prev.X, prev.Y, 0}, vector.Vector{pos.X, pos.Y, 0})
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].X != points[j].X {
+			return points[i].X < points[j].X
+		}
+		return points[i].Y < points[j].Y
+	})
+
+	if len(points) < 3 {
+		return points
+	}
+
+	// Monotone chain
+	turn := func(a, b, c vector.Vector) float64 {
+		return b.Diff(a).Cross(c.Diff(a)).Z
+	}
+
+	hull := make([]vector.Vector, 0, 2*len(points))
+	for _, p := range points {
+		for len(hull) >= 2 && turn(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	lower := len(hull) + 1
+	for idx := len(points) - 2; idx >= 0; idx-- {
+		p := points[idx]
+		for len(hull) >= lower && turn(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	return hull[:len(hull)-1]
+}
+
+// Calculates the minimum-area rectangle enclosing the Footprint, by rotating calipers.
+// w is the extent along the angle (radians, in [0, pi/2)) from the X axis, and h the extent
+// perpendicular to it. The center has Z set to 0.
+func (vm *Machine) MinAreaBox() (center vector.Vector, w, h, angle float64) {
+	hull := vm.Footprint()
+	if len(hull) == 0 {
+		return
+	}
+	center = hull[0]
+
+	best := math.Inf(1)
+	for idx := range hull {
+		a, b := hull[idx], hull[(idx+1)%len(hull)]
+		if math.Hypot(b.X-a.X, b.Y-a.Y) < epsilon {
+			continue
+		}
+		theta := math.Mod(math.Atan2(b.Y-a.Y, b.X-a.X)+2*math.Pi, math.Pi/2)
+		cos, sin := math.Cos(theta), math.Sin(theta)
+
+		// Project onto the axes of the edge
+		minu, minv := math.Inf(1), math.Inf(1)
+		maxu, maxv := math.Inf(-1), math.Inf(-1)
+		for _, p := range hull {
+			u, v := p.X*cos+p.Y*sin, -p.X*sin+p.Y*cos
+			minu, maxu = math.Min(minu, u), math.Max(maxu, u)
+			minv, maxv = math.Min(minv, v), math.Max(maxv, v)
+		}
+
+		if area := (maxu - minu) * (maxv - minv); area < best-epsilon {
+			best = area
+			w, h, angle = maxu-minu, maxv-minv, theta
+			cu, cv := (minu+maxu)/2, (minv+maxv)/2
+			center = vector.Vector{cu*cos - cv*sin, cu*sin + cv*cos, 0}
+		}
+	}
+	return
+}
+
+// A dwell and its position index
+type Dwell struct {
+	Index   int
+	Seconds float64
+}
+
+// Lists every dwell in the program
+func (vm *Machine) Dwells() []Dwell {
+	var res []Dwell
+	for idx, pos := range vm.Positions {
+		if pos.State.MoveMode == MoveModeDwell {
+			res = append(res, Dwell{idx, pos.State.DwellTime})
+		}
+	}
+	return res
+}
+
+// Calculates the maximum depth of cut below the stock top for every tool index
+func (vm *Machine) ToolMaxDepth() map[int]float64 {
+	res := make(map[int]float64)
+	for _, pos := range vm.Positions {
+		if !vm.cutting(pos) {
+			continue
+		}
+		depth := vm.StockTop - pos.Z
+		if d, ok := res[pos.State.ToolIndex]; !ok || depth > d {
+			res[pos.State.ToolIndex] = depth
+		}
+	}
+	return res
+}
+
+// Tests if the XY footprint of the cutting moves is mirror-symmetric about a line parallel to the
+// given axis, through the center of their extents. Moves are compared segment by segment, within
+// eps, ignoring plunges. Only AxisX and AxisY are supported.
+func (vm *Machine) IsSymmetric(axis Axis, eps float64) bool {
+	var (
+		segments [][2]Position
+		points   []Position
+	)
+	for idx, pos := range vm.Positions {
+		if idx > 0 && vm.cutting(pos) && (pos.X != vm.Positions[idx-1].X || pos.Y != vm.Positions[idx-1].Y) {
+			segments = append(segments, [2]Position{vm.Positions[idx-1], pos})
+			points = append(points, vm.Positions[idx-1], pos)
+		}
+	}
+	minx, miny, _, maxx, maxy, _ := extents(points)
+
+	var mirror func(p Position) Position
+	switch axis {
+	case AxisX:
+		mirror = func(p Position) Position {
+			p.Y = miny + maxy - p.Y
+			return p
+		}
+	case AxisY:
+		mirror = func(p Position) Position {
+			p.X = minx + maxx - p.X
+			return p
+		}
+	default:
+		return false
+	}
+
+	near := func(a, b Position) bool {
+		return math.Hypot(a.X-b.X, a.Y-b.Y) <= eps
+	}
+
+	for _, s := range segments {
+		a, b := mirror(s[0]), mirror(s[1])
+		found := false
+		for _, o := range segments {
+			if (near(a, o[0]) && near(b, o[1])) || (near(a, o[1]) && near(b, o[0])) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Usage of a tool
+type ToolUse struct {
+	Tool       int
+	FirstIndex int // Position index of first use
+	Moves      int
+}
+
+// Summarizes the usage of every tool, in order of first use
+func (vm *Machine) ToolSummary() []ToolUse {
+	var (
+		res   []ToolUse
+		index map[int]int = make(map[int]int)
+	)
+	for idx, pos := range vm.Positions {
+		t := pos.State.ToolIndex
+		if t == -1 {
+			continue
+		}
+		i, ok := index[t]
+		if !ok {
+			i = len(res)
+			index[t] = i
+			res = append(res, ToolUse{Tool: t, FirstIndex: idx})
+		}
+		if pos.State.MoveMode == MoveModeRapid || pos.State.MoveMode == MoveModeLinear {
+			res[i].Moves++
+		}
+	}
+	return res
+}
+
+// Groups cutting moves into layers by Z level, as position indexes.
+func (vm *Machine) layerIndexes(eps float64) [][]int {
+	var (
+		res   [][]int
+		layer []int
+	)
+	for idx, pos := range vm.Positions {
+		if !vm.cutting(pos) {
+			continue
+		}
+		if len(layer) > 0 && math.Abs(pos.Z-vm.Positions[layer[0]].Z) > eps {
+			res = append(res, layer)
+			layer = nil
+		}
+		layer = append(layer, idx)
+	}
+	if len(layer) > 0 {
+		res = append(res, layer)
+	}
+	return res
+}
+
+// Groups cutting moves into layers by Z level.
+// A new layer starts whenever a cutting move ends more than eps from the Z of the current layer.
+// Moves above the stock top are left out, and do not end layers.
+func (vm *Machine) LayersByZ(eps float64) [][]Position {
+	var res [][]Position
+	for _, layer := range vm.layerIndexes(eps) {
+		positions := make([]Position, len(layer))
+		for idx, i := range layer {
+			positions[idx] = vm.Positions[i]
+		}
+		res = append(res, positions)
+	}
+	return res
+}
+
+// Finds the longest rapid move, returning its position index and length.
+// The index is -1 if there are no rapid moves.
+func (vm *Machine) LongestRapid() (index int, length float64) {
+	index = -1
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		pos := vm.Positions[idx]
+		if pos.State.MoveMode != MoveModeRapid {
+			continue
+		}
+		if l := pos.Vector().Diff(vm.Positions[idx-1].Vector()).Norm(); l > length {
+			index, length = idx, l
+		}
+	}
+	return
+}
+
+// Estimates the stepover from the spacing between parallel cutting passes at the same Z.
+// Every straight pass is paired with the next parallel pass at its Z level, and spacings above
+// the tool diameter are ignored, as they are not overlapping passes. Returns the median spacing,
+// and whether all spacings are within 5% of it.
+func (vm *Machine) DetectStepover(toolRadius float64) (float64, bool) {
+	type pass struct {
+		x, y, z, dx, dy float64
+	}
+
+	var passes []pass
+	for idx, pos := range vm.Positions {
+		if idx == 0 || !vm.cutting(pos) {
+			continue
+		}
+		prev := vm.Positions[idx-1]
+		dx, dy := pos.X-prev.X, pos.Y-prev.Y
+		l := math.Hypot(dx, dy)
+		if l < epsilon || math.Abs(pos.Z-prev.Z) > epsilon {
+			continue
+		}
+		passes = append(passes, pass{prev.X, prev.Y, pos.Z, dx / l, dy / l})
+	}
+
+	var spacings []float64
+	for i, a := range passes {
+		for _, b := range passes[i+1:] {
+			if math.Abs(a.z-b.z) > epsilon || math.Abs(a.dx*b.dy-a.dy*b.dx) > 1e-6 {
+				continue
+			}
+			d := math.Abs((b.x-a.x)*a.dy - (b.y-a.y)*a.dx)
+			if d < epsilon {
+				// Same line
+				continue
+			}
+			if d <= 2*toolRadius+epsilon {
+				spacings = append(spacings, d)
+			}
+			break
+		}
+	}
+
+	if len(spacings) == 0 {
+		return 0, false
+	}
+
+	sort.Float64s(spacings)
+	median := spacings[len(spacings)/2]
+	for _, s := range spacings {
+		if math.Abs(s-median) > 0.05*median {
+			return median, false
+		}
+	}
+	return median, true
+}
+
+// Counts moves by length.
+// Every move is counted in the smallest bucket that its length does not exceed, or in +Inf if
+// longer than all buckets. Only moves of the given move modes are counted, or rapid and linear
+// moves if none are given.
+func (vm *Machine) MoveLengthHistogram(buckets []float64, moveModes ...int) map[float64]int {
+	if len(moveModes) == 0 {
+		moveModes = []int{MoveModeRapid, MoveModeLinear}
+	}
+
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+
+	res := make(map[float64]int)
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		pos := vm.Positions[idx]
+		counted := false
+		for _, mode := range moveModes {
+			counted = counted || pos.State.MoveMode == mode
+		}
+		if !counted {
+			continue
+		}
+
+		l := pos.Vector().Diff(vm.Positions[idx-1].Vector()).Norm()
+		bucket := math.Inf(1)
+		if i := sort.SearchFloat64s(sorted, l); i < len(sorted) {
+			bucket = sorted[i]
+		}
+		res[bucket]++
+	}
+	return res
+}
+
+// Calculates the total distance of rapid and feed moves
+func (vm *Machine) TravelStats() (rapid, feed float64) {
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		pos := vm.Positions[idx]
+		dist := pos.Vector().Diff(vm.Positions[idx-1].Vector()).Norm()
+		switch pos.State.MoveMode {
+		case MoveModeRapid:
+			rapid += dist
+		case MoveModeLinear:
+			feed += dist
+		}
+	}
+	return
+}
+
+// Calculates the share of the total travel that is rapid moves, or 0 if nothing moves
+func (vm *Machine) AirCuttingRatio() float64 {
+	rapid, feed := vm.TravelStats()
+	if rapid+feed == 0 {
+		return 0
+	}
+	return rapid / (rapid + feed)
+}
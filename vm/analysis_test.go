@@ -0,0 +1,324 @@
+package vm
+
+import "fmt"
+import "math"
+import "strings"
+import "testing"
+import "github.com/kennylevinsen/gocnc/gcode"
+import "github.com/kennylevinsen/gocnc/vector"
+
+func TestEngagementEstimate(t *testing.T) {
+	m := process(t, "G21G90\nG0Z1\nG1F100Z-1\nX20\nY2\nX0\n")
+	e := m.EngagementEstimate(3, 2)
+	if len(e) != len(m.Positions) {
+		t.Fatalf("expected %d estimates, got %d", len(m.Positions), len(e))
+	}
+	if e[3] != math.Pi {
+		t.Errorf("expected the first pass to be a full slot, got %f", e[3])
+	}
+	if expected := math.Acos(1 - 2.0/3); math.Abs(e[5]-expected) > 1e-9 {
+		t.Errorf("expected an engagement of %f on the second pass, got %f", expected, e[5])
+	}
+	if e[2] != 0 || e[1] != 0 {
+		t.Errorf("expected no engagement for Z moves, got %f and %f", e[1], e[2])
+	}
+}
+
+func TestStockTopIsInStock(t *testing.T) {
+	// Engraving at the stock top
+	m := process(t, "G21G90\nG0Z5\nG1F100Z0\nX10\n")
+	ops := m.Operations()
+	if len(ops) != 1 || ops[0].Start != 2 || ops[0].End != 4 {
+		t.Errorf("expected the cut at the stock top to be an operation, got %v", ops)
+	}
+	if d, ok := m.ToolMaxDepth()[m.Positions[3].State.ToolIndex]; !ok || d != 0 {
+		t.Errorf("expected a depth of 0 for the cut at the stock top, got %f (%t)", d, ok)
+	}
+	n := len(m.Positions)
+	m.Return(false, false)
+	if p := m.Positions[n]; p.X != 10 || p.Z != 5 {
+		t.Errorf("expected a retract before returning, got %v", p.Vector())
+	}
+}
+
+// A zigzag pocket of passes at the given stepover, one layer deep
+func zigzag(passes int, stepover float64) string {
+	var src strings.Builder
+	src.WriteString("G21G90\nG0Z1\nG1F100Z-1\n")
+	for idx := 0; idx < passes; idx++ {
+		x := 0
+		if idx%2 == 0 {
+			x = 50
+		}
+		fmt.Fprintf(&src, "X%dY%g\nY%g\n", x, float64(idx)*stepover, float64(idx+1)*stepover)
+	}
+	return src.String()
+}
+
+func TestEngagementEstimateLarge(t *testing.T) {
+	m := process(t, zigzag(5000, 2))
+	e := m.EngagementEstimate(3, 2)
+	partial := math.Acos(1 - 2.0/3)
+
+	// Only the first pass is a full slot, apart from the steps between passes, which have no
+	// parallel neighbour within reach
+	for idx := 3; idx < len(m.Positions); idx++ {
+		a, b := m.Positions[idx-1], m.Positions[idx]
+		switch {
+		case a.Y != b.Y:
+			if e[idx] != math.Pi {
+				t.Fatalf("position %d: expected the step to be a full slot, got %f", idx, e[idx])
+			}
+		case idx == 3:
+			if e[idx] != math.Pi {
+				t.Fatalf("expected the first pass to be a full slot, got %f", e[idx])
+			}
+		default:
+			if math.Abs(e[idx]-partial) > 1e-9 {
+				t.Fatalf("position %d: expected an engagement of %f, got %f", idx, partial, e[idx])
+			}
+		}
+	}
+}
+
+func BenchmarkEngagementEstimate(b *testing.B) {
+	doc, err := gcode.Parse(zigzag(5000, 2))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var m Machine
+	m.Init()
+	if err := m.Process(doc); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for idx := 0; idx < b.N; idx++ {
+		m.EngagementEstimate(3, 2)
+	}
+}
+
+func TestOperationBounds(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG0X0Y0\nG1F100Z-1\nX10\nY5\nG0Z5\nG0X20Y20\nG1Z-3\nX30Y25\nG0Z5\n")
+	b := m.OperationBounds()
+	expected := []OperationBox{
+		{Op: 0, MinX: 0, MinY: 0, MinZ: -1, MaxX: 10, MaxY: 5, MaxZ: -1},
+		{Op: 1, MinX: 20, MinY: 20, MinZ: -3, MaxX: 30, MaxY: 25, MaxZ: -3},
+	}
+	if len(b) != len(expected) {
+		t.Fatalf("expected %d boxes, got %v", len(expected), b)
+	}
+	for idx := range expected {
+		if b[idx] != expected[idx] {
+			t.Errorf("operation %d: expected %+v, got %+v", idx, expected[idx], b[idx])
+		}
+	}
+}
+
+func TestChunks(t *testing.T) {
+	src := "G21G90\nG0Z5\n"
+	for i := 0; i < 4; i++ {
+		src += fmt.Sprintf("G0X0Y%d\nG1F100Z-1\nX10\nX0\nG0Z5\n", i)
+	}
+	m := process(t, src)
+	chunks := m.Chunks(6)
+	total := 0
+	for idx, c := range chunks {
+		total += len(c)
+		if len(c) > 6 {
+			t.Errorf("chunk %d: %d positions exceed the limit", idx, len(c))
+		}
+		if last := c[len(c)-1]; idx != len(chunks)-1 && last.Z != 5 {
+			t.Errorf("chunk %d: ends at %v, below safety height", idx, last.Vector())
+		}
+	}
+	if total != len(m.Positions) || len(chunks) < 2 {
+		t.Errorf("expected all %d positions in several chunks, got %d in %d", len(m.Positions), total, len(chunks))
+	}
+}
+
+func TestFootprint(t *testing.T) {
+	m := process(t, "G21G90\nG0X0Y0Z5\nG1F100Z-1\nX10\nY10\nX5Y5\nX0Y10\nY0\nG0Z5\nX50Y50\n")
+	hull := m.Footprint()
+	expected := []vector.Vector{{0, 0, 0}, {10, 0, 0}, {10, 10, 0}, {0, 10, 0}}
+	if len(hull) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, hull)
+	}
+	for idx := range expected {
+		if hull[idx] != expected[idx] {
+			t.Errorf("vertex %d: expected %v, got %v", idx, expected[idx], hull[idx])
+		}
+	}
+}
+
+func TestDwells(t *testing.T) {
+	m := process(t, "G21G90\nM3S1000\nG1F100X10\nG4P1.5\nM4\nG1X20\n")
+	m.InsertSpindleReversalDwell(2)
+	d := m.Dwells()
+	if len(d) != 2 {
+		t.Fatalf("expected 2 dwells, got %v", d)
+	}
+	if d[0].Seconds != 1.5 || d[1].Seconds != 2 {
+		t.Errorf("expected dwells of 1.5s and 2s, got %v", d)
+	}
+	for _, dwell := range d {
+		if pos := m.Positions[dwell.Index]; pos.State.MoveMode != MoveModeDwell || pos.X != 10 {
+			t.Errorf("expected a dwell at X10, got %v at index %d", pos.Vector(), dwell.Index)
+		}
+	}
+}
+
+func TestToolMaxDepth(t *testing.T) {
+	m := process(t, "G21G90\nT1M6\nG0Z5\nG1F100Z-2\nX10\nZ-4\nX0\nG0Z5\nT2M6\nG1Z-1\nX10\nG0Z5\n")
+	d := m.ToolMaxDepth()
+	expected := map[int]float64{1: 4, 2: 1}
+	if len(d) != len(expected) {
+		t.Errorf("expected %v, got %v", expected, d)
+	}
+	for tool, depth := range expected {
+		if d[tool] != depth {
+			t.Errorf("tool %d: expected a depth of %f, got %f", tool, depth, d[tool])
+		}
+	}
+}
+
+func TestIsSymmetric(t *testing.T) {
+	cross := process(t, "G21G90\nG0X0Y10Z5\nG1F100Z-1\nX20\nG0Z5\nX10Y0\nG1Z-1\nY20\nG0Z5\n")
+	for _, axis := range []Axis{AxisX, AxisY} {
+		if !cross.IsSymmetric(axis, 1e-6) {
+			t.Errorf("expected the cross to be symmetric about axis %d", axis)
+		}
+	}
+
+	l := process(t, "G21G90\nG0X0Y20Z5\nG1F100Z-1\nY0\nX10\nG0Z5\n")
+	for _, axis := range []Axis{AxisX, AxisY} {
+		if l.IsSymmetric(axis, 1e-6) {
+			t.Errorf("expected the L not to be symmetric about axis %d", axis)
+		}
+	}
+}
+
+func TestToolSummary(t *testing.T) {
+	m := process(t, "G21G90\nT2M6\nG0X1\nG1F100X2\nT1M6\nG0X3\nT2M6\nG0X4\n")
+	s := m.ToolSummary()
+	expected := []ToolUse{{Tool: 2, FirstIndex: 1, Moves: 3}, {Tool: 1, FirstIndex: 3, Moves: 1}}
+	if len(s) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, s)
+	}
+	for idx := range expected {
+		if s[idx] != expected[idx] {
+			t.Errorf("tool %d: expected %+v, got %+v", idx, expected[idx], s[idx])
+		}
+	}
+}
+
+func TestLayersByZ(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG1F100Z-1\nX10\nY10\nG0Z5\nX0Y0\nG1Z-2\nX10\nG0Z5\nX0Y0\nG1Z-3\nX10\nY10\nX0\nG0Z5\n")
+	layers := m.LayersByZ(1e-6)
+	sizes := []int{3, 2, 4}
+	if len(layers) != len(sizes) {
+		t.Fatalf("expected %d layers, got %d", len(sizes), len(layers))
+	}
+	for idx, layer := range layers {
+		if len(layer) != sizes[idx] {
+			t.Errorf("layer %d: expected %d moves, got %d", idx, sizes[idx], len(layer))
+		}
+		for _, pos := range layer {
+			if pos.Z != float64(-1-idx) {
+				t.Errorf("layer %d: unexpected move at %v", idx, pos.Vector())
+			}
+		}
+	}
+}
+
+func TestLongestRapid(t *testing.T) {
+	m := process(t, "G21G90\nG0X3Y4\nG1F100X10\nG0X10Y30\nG0X0Y30\n")
+	idx, length := m.LongestRapid()
+	if idx != 3 || length != 26 {
+		t.Errorf("expected the rapid at 3 of length 26, got %d of length %f", idx, length)
+	}
+
+	m = process(t, "G21G90\nG1F100X10\n")
+	if idx, _ := m.LongestRapid(); idx != -1 {
+		t.Errorf("expected no rapid, got %d", idx)
+	}
+}
+
+func TestDetectStepover(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG1F100Z-1\nX20\nY3\nX0\nY6\nX20\nY9\nX0\nG0Z5\n")
+	stepover, consistent := m.DetectStepover(3)
+	if math.Abs(stepover-3) > 1e-9 || !consistent {
+		t.Errorf("expected a consistent stepover of 3, got %f (%v)", stepover, consistent)
+	}
+
+	m = process(t, "G21G90\nG0Z5\nG1F100Z-1\nX20\nY1\nX0\nY5\nX20\nY6\nX0\nG0Z5\n")
+	if _, consistent := m.DetectStepover(3); consistent {
+		t.Error("expected mixed stepovers to be inconsistent")
+	}
+}
+
+func TestMoveLengthHistogram(t *testing.T) {
+	m := process(t, "G21G90\nG0X0.5\nX1.5\nG1F100X1.6\nX11.6\nX111.6\n")
+	h := m.MoveLengthHistogram([]float64{10, 1})
+	expected := map[float64]int{1: 3, 10: 1, math.Inf(1): 1}
+	if len(h) != len(expected) {
+		t.Errorf("expected %v, got %v", expected, h)
+	}
+	for bucket, count := range expected {
+		if h[bucket] != count {
+			t.Errorf("bucket %v: expected %d moves, got %d", bucket, count, h[bucket])
+		}
+	}
+
+	h = m.MoveLengthHistogram([]float64{1, 10}, MoveModeRapid)
+	if h[1] != 2 || len(h) != 1 {
+		t.Errorf("expected 2 short rapids, got %v", h)
+	}
+}
+
+func TestAirCuttingRatio(t *testing.T) {
+	m := process(t, "G21G90\nG0X30\nG1F100X40\n")
+	rapid, feed := m.TravelStats()
+	if rapid != 30 || feed != 10 {
+		t.Errorf("expected 30 rapid and 10 feed, got %f and %f", rapid, feed)
+	}
+	if r := m.AirCuttingRatio(); r != 0.75 {
+		t.Errorf("expected a ratio of 0.75, got %f", r)
+	}
+	if err := m.CheckAirCuttingRatio(0.5); err == nil {
+		t.Error("expected the ratio to exceed 0.5")
+	}
+	if err := m.CheckAirCuttingRatio(0.8); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestContourEntryPoints(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG0X2Y1\nG1F100Z-1\nX10\nY10\nX2\nY1\nG0Z5\n"+
+		"G0X20Y20\nG1Z-1\nX30\nY30\nX20\nY20\nG0Z5\n"+
+		"G0X40Y0\nG1Z-1\nX50\nG0Z5\n")
+	e := m.ContourEntryPoints()
+	expected := []vector.Vector{{2, 1, 0}, {20, 20, 0}}
+	if len(e) != len(expected) {
+		t.Fatalf("expected %d entry points, got %v", len(expected), e)
+	}
+	for idx := range expected {
+		if e[idx] != expected[idx] {
+			t.Errorf("contour %d: expected %v, got %v", idx, expected[idx], e[idx])
+		}
+	}
+}
+
+func TestMinAreaBox(t *testing.T) {
+	// A 10x4 rectangle rotated by 30 degrees
+	m := process(t, "G21G90\nG0Z5\nG0X0Y0\nG1F100Z-1\nX8.660254Y5\nX6.660254Y8.464102\nX-2Y3.464102\nX0Y0\nG0Z5\n")
+	c, w, h, angle := m.MinAreaBox()
+	if math.Abs(w-10) > 1e-4 || math.Abs(h-4) > 1e-4 {
+		t.Errorf("expected a 10x4 box, got %fx%f", w, h)
+	}
+	if math.Abs(angle-math.Pi/6) > 1e-4 {
+		t.Errorf("expected an angle of %f, got %f", math.Pi/6, angle)
+	}
+	if math.Abs(c.X-3.330127) > 1e-4 || math.Abs(c.Y-4.232051) > 1e-4 || c.Z != 0 {
+		t.Errorf("unexpected center: %v", c)
+	}
+}
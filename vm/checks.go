@@ -0,0 +1,562 @@
+package vm
+
+import "errors"
+import "fmt"
+import "math"
+
+// Updates the position indexes of diagnostics after positions have been rewritten.
+// remap holds the new index of every old position, or -1 for removed positions. Removed positions
+// may also map to an identical position that replaced them. Arcs are kept only if all their
+// positions remain, with nothing inserted between them, as otherwise their linearization no longer
+// matches. Redundant tool changes move to the next remaining position.
+func (vm *Machine) RemapDiagnostics(remap []int) {
+	arcs := vm.Arcs[:0]
+	for _, a := range vm.Arcs {
+		keep := a.End < len(remap) && remap[a.Index] >= 0
+		for idx := a.Index + 1; keep && idx <= a.End; idx++ {
+			step := remap[idx] - remap[idx-1]
+			keep = remap[idx] >= 0 && (step == 0 || step == 1)
+		}
+		if keep {
+			a.Index, a.End = remap[a.Index], remap[a.End]
+			arcs = append(arcs, a)
+		}
+	}
+	vm.Arcs = arcs
+
+	for idx, c := range vm.redundantToolChanges {
+		for c < len(remap) && remap[c] < 0 {
+			c++
+		}
+		if c < len(remap) {
+			vm.redundantToolChanges[idx] = remap[c]
+		} else {
+			vm.redundantToolChanges[idx] = len(vm.Positions)
+		}
+	}
+}
+
+// Finds arcs sweeping more than maxSweep radians.
+// A sweep above pi often means that G2 and G3 have been mixed up.
+// Returns the position index of the first segment of each arc, as produced by Process.
+func (vm *Machine) CheckArcSweep(maxSweep float64) []int {
+	var res []int
+	for _, a := range vm.Arcs {
+		if a.Sweep > maxSweep {
+			res = append(res, a.Index)
+		}
+	}
+	return res
+}
+
+// Finds tool changes to the tool that was already active.
+// Returns the index of the first position after each redundant change, as produced by Process.
+func (vm *Machine) CheckRedundantToolChange() []int {
+	return append([]int(nil), vm.redundantToolChanges...)
+}
+
+// Finds blocks that set plane, units, distance or feedrate modes that were already set to the
+// same value. Returns the index of each such block, as given to Process.
+func (vm *Machine) CheckRedundantModals() []int {
+	return append([]int(nil), vm.redundantModals...)
+}
+
+// Finds operations that change between climb and conventional milling partway through.
+// The cutting direction relative to the spindle rotation is used, so reversing both the path and
+// the spindle is consistent. The cutting direction is sampled over chords of at least toolRadius
+// length to ignore facets.
+func (vm *Machine) CheckDirectionConsistency(toolRadius float64) []error {
+	var res []error
+	for _, op := range vm.Operations() {
+		var (
+			turn, lastAngle float64
+			mode            int
+			hasAngle        bool
+			chord           Position = vm.Positions[op.Start]
+		)
+
+		for idx := op.Start + 1; idx < op.End; idx++ {
+			pos := vm.Positions[idx]
+			if pos.State.MoveMode != MoveModeLinear {
+				continue
+			}
+			dx, dy := pos.X-chord.X, pos.Y-chord.Y
+			if math.Hypot(dx, dy) < toolRadius || math.Hypot(dx, dy) < epsilon {
+				continue
+			}
+			chord = pos
+
+			angle := math.Atan2(dy, dx)
+			if hasAngle {
+				diff := math.Remainder(angle-lastAngle, 2*math.Pi)
+				turn += diff
+				if math.Abs(turn) > math.Pi {
+					m := 1
+					if turn < 0 {
+						m = -1
+					}
+					if !pos.State.SpindleClockwise {
+						m = -m
+					}
+					if mode != 0 && m != mode {
+						res = append(res, errors.New(fmt.Sprintf("Operation at position %d changes between climb and conventional milling at position %d", op.Start, idx)))
+						break
+					}
+					mode = m
+					turn = 0
+				}
+			}
+			lastAngle, hasAngle = angle, true
+		}
+	}
+	return res
+}
+
+// Finds arcs directly preceded by a plane change, without an intervening move.
+// This often signals a post-processor bug.
+// Returns the position index of the first segment of each arc, as produced by Process.
+func (vm *Machine) CheckPlaneConsistency() []int {
+	var res []int
+	for _, a := range vm.Arcs {
+		if a.PlaneChanged {
+			res = append(res, a.Index)
+		}
+	}
+	return res
+}
+
+// Finds cutting moves deeper than maxDepth below the stock top, which would require more
+// tool stick-out than available.
+func (vm *Machine) CheckToolReach(maxDepth float64) []int {
+	var res []int
+	for idx, pos := range vm.Positions {
+		if vm.cutting(pos) && vm.StockTop-pos.Z > maxDepth {
+			res = append(res, idx)
+		}
+	}
+	return res
+}
+
+// Finds cutting moves made with the spindle disabled.
+// Consecutive offending moves are reported as one region.
+func (vm *Machine) CheckSpindleOnDuringCut() []error {
+	var (
+		res   []error
+		start int = -1
+	)
+	report := func(end int) {
+		res = append(res, errors.New(fmt.Sprintf("Cutting with spindle disabled from position %d to %d", start, end)))
+		start = -1
+	}
+	for idx, pos := range vm.Positions {
+		if vm.cutting(pos) && !pos.State.SpindleEnabled {
+			if start == -1 {
+				start = idx
+			}
+		} else if start != -1 {
+			report(idx - 1)
+		}
+	}
+	if start != -1 {
+		report(len(vm.Positions) - 1)
+	}
+	return res
+}
+
+// Checks that the spindle is started before the first cutting move.
+func (vm *Machine) CheckSpindleStartedBeforeCut() error {
+	for idx, pos := range vm.Positions {
+		if pos.State.SpindleEnabled {
+			return nil
+		}
+		if vm.cutting(pos) {
+			return errors.New(fmt.Sprintf("First cut at position %d is made before the spindle is started", idx))
+		}
+	}
+	return nil
+}
+
+// Finds cutting moves made with the spindle enabled, but at a speed of zero.
+func (vm *Machine) CheckSpindleSpeedZero() []int {
+	var res []int
+	for idx, pos := range vm.Positions {
+		if vm.cutting(pos) && pos.State.SpindleEnabled && pos.State.SpindleSpeed == 0 {
+			res = append(res, idx)
+		}
+	}
+	return res
+}
+
+// Finds vertical plunges made while already below the stock top, between consecutive passes of an
+// operation that retrace the same path. Such step-downs are usually meant to be continuous
+// (helical) ramps. Plunges into passes covering other areas are not reported.
+func (vm *Machine) CheckStepdownContinuity() []int {
+	var res []int
+	for _, op := range vm.Operations() {
+		// The plunges split the operation into passes
+		var plunges []int
+		for idx := op.Start + 1; idx < op.End; idx++ {
+			last, pos := vm.Positions[idx-1], vm.Positions[idx]
+			if pos.State.MoveMode == MoveModeLinear && pos.Z < last.Z-epsilon &&
+				math.Abs(pos.X-last.X) < epsilon && math.Abs(pos.Y-last.Y) < epsilon {
+				plunges = append(plunges, idx)
+			}
+		}
+
+		for n, idx := range plunges {
+			start, end := op.Start, op.End
+			if n > 0 {
+				start = plunges[n-1]
+			}
+			if n+1 < len(plunges) {
+				end = plunges[n+1]
+			}
+			if samePath(vm.Positions[start:idx], vm.Positions[idx:end]) {
+				res = append(res, idx)
+			}
+		}
+	}
+	return res
+}
+
+// Tests if two passes cover the same XY area, within 1% of its size
+func samePath(a, b []Position) bool {
+	aminx, aminy, _, amaxx, amaxy, _ := extents(a)
+	bminx, bminy, _, bmaxx, bmaxy, _ := extents(b)
+	size := math.Max(math.Hypot(amaxx-aminx, amaxy-aminy), math.Hypot(bmaxx-bminx, bmaxy-bminy))
+	if len(a) < 2 || len(b) < 2 || size < epsilon {
+		return false
+	}
+	tolerance := size / 100
+	return math.Abs(aminx-bminx) <= tolerance && math.Abs(aminy-bminy) <= tolerance &&
+		math.Abs(amaxx-bmaxx) <= tolerance && math.Abs(amaxy-bmaxy) <= tolerance
+}
+
+// Finds spindle transitions that are wasted, as the spindle is enabled and disabled again (or the
+// program ends) without any cutting move in between.
+// Returns the position indices of both transitions.
+func (vm *Machine) CheckSpindleToggleNoCut() []int {
+	var (
+		res   []int
+		start int = -1
+		cut   bool
+	)
+	for idx, pos := range vm.Positions {
+		if pos.State.SpindleEnabled {
+			if start == -1 {
+				start, cut = idx, false
+			}
+			if vm.cutting(pos) {
+				cut = true
+			}
+		} else if start != -1 {
+			if !cut {
+				res = append(res, start, idx)
+			}
+			start = -1
+		}
+	}
+	if start != -1 && !cut {
+		res = append(res, start)
+	}
+	return res
+}
+
+// Finds cutting moves too short to accelerate to half their feedrate from standstill, given an
+// acceleration in mm/s^2. Such feedrates are never reached, which usually indicates a mistake.
+func (vm *Machine) CheckUnreachableFeed(accel float64) []int {
+	var res []int
+	if accel <= 0 {
+		return res
+	}
+	for idx, pos := range vm.Positions {
+		if idx == 0 || !vm.cutting(pos) || pos.State.FeedMode == FeedModeInvTime {
+			continue
+		}
+		v := pos.State.Feedrate / 60 / 2
+		dist := pos.Vector().Diff(vm.Positions[idx-1].Vector()).Norm()
+		if dist > epsilon && dist < v*v/(2*accel) {
+			res = append(res, idx)
+		}
+	}
+	return res
+}
+
+// Finds feed moves with a feedrate above rapidRate (mm/min). Such moves run slower than the
+// rapids, which usually indicates a units mistake.
+func (vm *Machine) CheckFeedExceedsRapid(rapidRate float64) []int {
+	var res []int
+	for idx, pos := range vm.Positions {
+		if pos.State.MoveMode == MoveModeLinear && pos.State.FeedMode != FeedModeInvTime &&
+			pos.State.Feedrate > rapidRate {
+			res = append(res, idx)
+		}
+	}
+	return res
+}
+
+// Finds feed moves that travel less than eps, which some controllers treat as dwells or errors.
+func (vm *Machine) CheckNoOpCuts(eps float64) []int {
+	var res []int
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		pos := vm.Positions[idx]
+		if pos.State.MoveMode == MoveModeLinear && pos.Vector().Diff(vm.Positions[idx-1].Vector()).Norm() < eps {
+			res = append(res, idx)
+		}
+	}
+	return res
+}
+
+// Finds corners where the feedrate is slowed so much that the chip load drops below minLoad (mm
+// per flute), which makes the tool rub rather than cut. Corners are vertices between cutting moves
+// that turn by more than 30 degrees, and their feedrate is the lowest of the moves within a tool
+// diameter of path length around them. Returns the position index of every such corner.
+// Moves without a spindle speed and inverse time moves are skipped.
+func (vm *Machine) CheckCornerChipLoad(toolDiameter float64, flutes int, minLoad float64) []int {
+	var res []int
+	if flutes <= 0 {
+		return res
+	}
+
+	mp := vm.Positions
+	length := func(idx int) float64 {
+		return mp[idx].Vector().Diff(mp[idx-1].Vector()).Norm()
+	}
+	usable := func(idx int) bool {
+		return idx > 0 && idx < len(mp) && vm.cutting(mp[idx]) && mp[idx].State.FeedMode != FeedModeInvTime
+	}
+
+	for idx := 1; idx < len(mp)-1; idx++ {
+		if !usable(idx) || !usable(idx+1) {
+			continue
+		}
+		a, b, c := mp[idx-1], mp[idx], mp[idx+1]
+		ab, bc := b.Vector().Diff(a.Vector()), c.Vector().Diff(b.Vector())
+		if b.State.SpindleSpeed <= 0 || ab.Norm() < epsilon || bc.Norm() < epsilon || ab.Dot(bc)/(ab.Norm()*bc.Norm()) > math.Cos(math.Pi/6) {
+			continue
+		}
+
+		feed := math.Min(b.State.Feedrate, c.State.Feedrate)
+		for i, dist := idx-1, ab.Norm(); dist < toolDiameter && usable(i); i-- {
+			feed = math.Min(feed, mp[i].State.Feedrate)
+			dist += length(i)
+		}
+		for i, dist := idx+2, bc.Norm(); dist < toolDiameter && usable(i); i++ {
+			feed = math.Min(feed, mp[i].State.Feedrate)
+			dist += length(i)
+		}
+
+		if load := feed / (b.State.SpindleSpeed * float64(flutes)); load < minLoad {
+			res = append(res, idx)
+		}
+	}
+	return res
+}
+
+// Finds operations where the spindle speed changes between cutting moves.
+func (vm *Machine) CheckSpindleSpeedConstancy() []error {
+	var res []error
+	for idx, op := range vm.Operations() {
+		var (
+			speed float64
+			found bool
+		)
+		for i := op.Start; i < op.End; i++ {
+			pos := vm.Positions[i]
+			if !vm.cutting(pos) {
+				continue
+			}
+			if found && pos.State.SpindleSpeed != speed {
+				res = append(res, errors.New(fmt.Sprintf("Operation %d: spindle speed changes from %g to %g at position %d", idx, speed, pos.State.SpindleSpeed, i)))
+			}
+			speed, found = pos.State.SpindleSpeed, true
+		}
+	}
+	return res
+}
+
+// Checks that the program ends with the tool at or above safeZ.
+func (vm *Machine) CheckEndsRetracted(safeZ float64) error {
+	if len(vm.Positions) == 0 {
+		return nil
+	}
+	if pos := vm.Positions[len(vm.Positions)-1]; pos.Z < safeZ {
+		return errors.New(fmt.Sprintf("Program ends at Z%g, below safe height of %g", pos.Z, safeZ))
+	}
+	return nil
+}
+
+// Finds moves traveling further along an axis than the machine can, given the travel of every
+// axis. A travel <= 0 disables the check for that axis.
+func (vm *Machine) CheckMaxMove(dx, dy, dz float64) []int {
+	var res []int
+	exceeds := func(delta, travel float64) bool {
+		return travel > 0 && math.Abs(delta) > travel+epsilon
+	}
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		a, b := vm.Positions[idx-1], vm.Positions[idx]
+		if exceeds(b.X-a.X, dx) || exceeds(b.Y-a.Y, dy) || exceeds(b.Z-a.Z, dz) {
+			res = append(res, idx)
+		}
+	}
+	return res
+}
+
+// Finds rapids that travel laterally over the interior of the Footprint while below
+// stockTop+clearance, where the tool may pass over uncut material. Rapids along the edge of the
+// footprint are not flagged.
+func (vm *Machine) CheckRapidOverStock(stockTop, clearance float64) []int {
+	hull := vm.Footprint()
+	if len(hull) < 3 {
+		return nil
+	}
+
+	var res []int
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		a, b := vm.Positions[idx-1], vm.Positions[idx]
+		if b.State.MoveMode != MoveModeRapid || math.Min(a.Z, b.Z) >= stockTop+clearance {
+			continue
+		}
+		dx, dy := b.X-a.X, b.Y-a.Y
+		length := math.Hypot(dx, dy)
+		if length < epsilon {
+			continue
+		}
+
+		// Clip the move against the hull, which is counterclockwise
+		lo, hi := 0.0, 1.0
+		for i := range hull {
+			p, q := hull[i], hull[(i+1)%len(hull)]
+			ex, ey := q.X-p.X, q.Y-p.Y
+			el := math.Hypot(ex, ey)
+			if el < epsilon {
+				continue
+			}
+			nx, ny := -ey/el, ex/el
+			dist := nx*(a.X-p.X) + ny*(a.Y-p.Y) - epsilon
+			rate := nx*dx + ny*dy
+			if rate == 0 {
+				if dist < 0 {
+					hi = lo
+				}
+				continue
+			}
+			if t := -dist / rate; rate > 0 {
+				lo = math.Max(lo, t)
+			} else {
+				hi = math.Min(hi, t)
+			}
+		}
+		z := math.Min(a.Z+(b.Z-a.Z)*lo, a.Z+(b.Z-a.Z)*hi)
+		if (hi-lo)*length > epsilon && z < stockTop+clearance {
+			res = append(res, idx)
+		}
+	}
+	return res
+}
+
+// Finds arcs that were approximated by a single linear segment, losing their curve entirely.
+// This happens when MaxArcDeviation is at least the radius, or MinArcLineLength is too large.
+func (vm *Machine) CheckCollapsedArcs() []int {
+	var res []int
+	for _, a := range vm.Arcs {
+		if a.Segments <= 1 {
+			res = append(res, a.Index)
+		}
+	}
+	return res
+}
+
+// Checks that arcs are linearized within partTolerance (mm).
+// MaxArcDeviation is checked, as well as the deviation of every arc as processed, as
+// MinArcLineLength and ArcSegmentsOverride can leave arcs coarser than MaxArcDeviation.
+// Collapsed arcs have no segment to measure, and are left to CheckCollapsedArcs.
+func (vm *Machine) CheckArcTolerance(partTolerance float64) error {
+	if vm.MaxArcDeviation > partTolerance {
+		return errors.New(fmt.Sprintf("Maximum arc deviation of %g exceeds part tolerance of %g", vm.MaxArcDeviation, partTolerance))
+	}
+	for _, a := range vm.Arcs {
+		axes, err := planeAxes(a.Plane)
+		if err != nil || a.End-a.Index < 2 {
+			continue
+		}
+
+		// The radius follows from the chord of the first segment and the angle it spans
+		p, q := vm.Positions[a.Index], vm.Positions[a.Index+1]
+		pv, qv := [3]float64{p.X, p.Y, p.Z}, [3]float64{q.X, q.Y, q.Z}
+		chord := math.Hypot(qv[axes[0]]-pv[axes[0]], qv[axes[1]]-pv[axes[1]])
+		half := a.Sweep / float64(a.Segments) / 2
+		if half <= 0 || half >= math.Pi/2 {
+			continue
+		}
+		radius := chord / 2 / math.Sin(half)
+		if dev := radius * (1 - math.Cos(half)); dev > partTolerance+epsilon {
+			return errors.New(fmt.Sprintf("Arc at position %d deviates by %g, exceeding part tolerance of %g", a.Index, dev, partTolerance))
+		}
+	}
+	return nil
+}
+
+// Finds operations where the surface speed of the tool exceeds maxSurfaceSpeed, in m/min.
+// The surface speed is calculated from the highest spindle speed of the operation, and the
+// diameter of its tool from Tools. Operations using tools without a diameter are skipped.
+func (vm *Machine) CheckSpindleVsTool(maxSurfaceSpeed float64) []error {
+	var res []error
+	for idx, op := range vm.Operations() {
+		tool := vm.Positions[op.Start].State.ToolIndex
+		t, ok := vm.Tools[tool]
+		if !ok || t.Diameter <= 0 {
+			continue
+		}
+
+		var rpm float64
+		for _, pos := range vm.Positions[op.Start:op.End] {
+			if pos.State.SpindleEnabled {
+				rpm = math.Max(rpm, pos.State.SpindleSpeed)
+			}
+		}
+
+		if speed := math.Pi * t.Diameter * rpm / 1000; speed > maxSurfaceSpeed {
+			res = append(res, errors.New(fmt.Sprintf("Operation %d: surface speed of %g m/min with tool %d exceeds %g m/min", idx, speed, tool, maxSurfaceSpeed)))
+		}
+	}
+	return res
+}
+
+// Checks that the share of the total travel that is rapid moves does not exceed maxRatio.
+func (vm *Machine) CheckAirCuttingRatio(maxRatio float64) error {
+	if ratio := vm.AirCuttingRatio(); ratio > maxRatio {
+		return errors.New(fmt.Sprintf("Rapid moves are %.1f%% of total travel, exceeding %.1f%%", ratio*100, maxRatio*100))
+	}
+	return nil
+}
+
+// Finds gaps in contours.
+// An operation is taken to be a closed contour if its end is within 1% of its length of its start,
+// and is flagged if the two still differ by more than eps. Gaps left by null moves within an
+// operation, such as those of CuttingOnly, are flagged as well.
+func (vm *Machine) CheckContourGaps(eps float64) []error {
+	var res []error
+	for idx, op := range vm.Operations() {
+		var length float64
+		for i := op.Start + 1; i < op.End; i++ {
+			a, b := vm.Positions[i-1], vm.Positions[i]
+			d := b.Vector().Diff(a.Vector()).Norm()
+			if b.State.MoveMode == MoveModeNone {
+				continue
+			}
+			if a.State.MoveMode == MoveModeNone && d > eps {
+				res = append(res, errors.New(fmt.Sprintf("Operation %d: gap of %g at position %d", idx, d, i)))
+				continue
+			}
+			length += d
+		}
+
+		start, end := vm.Positions[op.Start], vm.Positions[op.End-1]
+		gap := end.Vector().Diff(start.Vector()).Norm()
+		if gap > eps && gap < 0.01*length {
+			res = append(res, errors.New(fmt.Sprintf("Operation %d: contour not closed, gap of %g between positions %d and %d", idx, gap, op.Start, op.End-1)))
+		}
+	}
+	return res
+}
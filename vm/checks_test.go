@@ -0,0 +1,341 @@
+package vm
+
+import "math"
+import "strings"
+import "testing"
+import "github.com/kennylevinsen/gocnc/gcode"
+
+func TestCheckCollapsedArcs(t *testing.T) {
+	doc, err := gcode.Parse("G21G90\nG1F100X10Y0\nG3X0Y10I-10J0\nG3X-10Y0I0J-10\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Machine
+	m.Init()
+	m.MinArcLineLength = 1000
+	if err := m.Process(doc); err != nil {
+		t.Fatal(err)
+	}
+	if c := m.CheckCollapsedArcs(); len(c) != 2 {
+		t.Errorf("expected 2 collapsed arcs, got %v", c)
+	}
+
+	m2 := process(t, "G21G90\nG1F100X10Y0\nG3X0Y10I-10J0\n")
+	if c := m2.CheckCollapsedArcs(); len(c) != 0 {
+		t.Errorf("expected no collapsed arcs, got %v", c)
+	}
+}
+
+func TestCheckArcTolerance(t *testing.T) {
+	m := process(t, "G21G90\nG1F100X10Y0\nG3X0Y10I-10J0\n")
+	if err := m.CheckArcTolerance(0.01); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := m.CheckArcTolerance(0.001); err == nil {
+		t.Errorf("expected MaxArcDeviation to exceed the part tolerance")
+	}
+
+	src := "G21G90\nG1F100X10Y0\nG3X0Y10I-10J0\nG1X-20\n"
+	doc, err := gcode.Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var coarse Machine
+	coarse.Init()
+	coarse.ArcSegmentsOverride = 2
+	if err := coarse.Process(doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := coarse.CheckArcTolerance(0.5); err == nil {
+		t.Errorf("expected 2 segments at radius 10 to exceed a part tolerance of 0.5")
+	}
+	if err := coarse.CheckArcTolerance(1); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// Collapsed arcs must not be measured against the following move
+	doc, err = gcode.Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var collapsed Machine
+	collapsed.Init()
+	collapsed.MinArcLineLength = 1000
+	if err := collapsed.Process(doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := collapsed.CheckArcTolerance(0.01); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestCheckDirectionConsistency(t *testing.T) {
+	ccw := "X20Y0\nX20Y20\nX0Y20\nX0Y0\n"
+	cw := "X0Y20\nX20Y20\nX20Y0\nX0Y0\n"
+
+	m := process(t, "G21G90M3S1000\nG0X0Y0Z1\nG1F100Z-1\n"+ccw+cw+cw+"G0Z1\n")
+	if errs := m.CheckDirectionConsistency(1); len(errs) != 1 {
+		t.Errorf("expected the reversal to be flagged, got %v", errs)
+	}
+
+	m = process(t, "G21G90M3S1000\nG0X0Y0Z1\nG1F100Z-1\n"+ccw+ccw+"G0Z1\n")
+	if errs := m.CheckDirectionConsistency(1); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+
+	// Reversing the spindle along with the path keeps the cut consistent
+	m = process(t, "G21G90M3S1000\nG0X0Y0Z1\nG1F100Z-1\n"+ccw+"M4\n"+cw+cw+"G0Z1\n")
+	if errs := m.CheckDirectionConsistency(1); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	m = process(t, "G21G90M3S1000\nG0X0Y0Z1\nG1F100Z-1\n"+ccw+"M4\n"+ccw+"G0Z1\n")
+	if errs := m.CheckDirectionConsistency(1); len(errs) != 1 {
+		t.Errorf("expected the spindle reversal to be flagged, got %v", errs)
+	}
+}
+
+func TestCheckStepdownContinuity(t *testing.T) {
+	square := "X20Y0\nX20Y20\nX0Y20\nX0Y0\n"
+
+	m := process(t, "G21G90\nG0X0Y0Z1\nG1F100Z-1\n"+square+"Z-2\n"+square+"G0Z1\n")
+	c := m.CheckStepdownContinuity()
+	if len(c) != 1 || m.Positions[c[0]].Z != -2 {
+		t.Errorf("expected the plunge to Z-2 to be flagged, got %v", c)
+	}
+
+	ramp := "G21G90\nG0X0Y0Z1\nG1F100Z0\nX20Y0Z-0.25\nX20Y20Z-0.5\nX0Y20Z-0.75\nX0Y0Z-1\n" +
+		"X20Y0Z-1.25\nX20Y20Z-1.5\nX0Y20Z-1.75\nX0Y0Z-2\n" + square + "G0Z1\n"
+	m = process(t, ramp)
+	if c := m.CheckStepdownContinuity(); len(c) != 0 {
+		t.Errorf("unexpected discontinuities in a ramp: %v", c)
+	}
+
+	// Plunging into a pass elsewhere is not a step-down
+	m = process(t, "G21G90\nG0X0Y0Z1\nG1F100Z-1\n"+square+"X40Y0\nZ-2\nX60Y0\nX60Y20\nX40Y20\nX40Y0\nG0Z1\n")
+	if c := m.CheckStepdownContinuity(); len(c) != 0 {
+		t.Errorf("unexpected discontinuities: %v", c)
+	}
+}
+
+func TestCheckArcSweep(t *testing.T) {
+	m := process(t, "G21G90\nG1F100X10Y0\nG3X0Y-10I-10J0\nG2X-10Y0I0J10\n")
+	c := m.CheckArcSweep(math.Pi)
+	if len(c) != 1 || c[0] != m.Arcs[0].Index {
+		t.Errorf("expected the 270 degree arc at %d to be flagged, got %v", m.Arcs[0].Index, c)
+	}
+}
+
+func TestCheckRedundantToolChange(t *testing.T) {
+	m := process(t, "G21G90\nT1M6\nG1F100X10\nT1M6\nG1X20\nT2M6\nG1X30\n")
+	c := m.CheckRedundantToolChange()
+	if len(c) != 1 {
+		t.Fatalf("expected 1 redundant tool change, got %v", c)
+	}
+	if p := m.Positions[c[0]]; p.X != 20 {
+		t.Errorf("expected the change before X20, got %v", p.Vector())
+	}
+
+	// The result is a copy, so changing it does not affect the machine
+	c[0] = 0
+	if c := m.CheckRedundantToolChange(); c[0] == 0 {
+		t.Error("redundant tool changes of the machine were modified through the result")
+	}
+}
+
+func TestCheckPlaneConsistency(t *testing.T) {
+	m := process(t, "G21G90\nG1F100X10Y0\nG18\nG2X0Z10I-10K0\nG17\nG1X10Y0Z0\nG2X0Y10I-10J0\n")
+	c := m.CheckPlaneConsistency()
+	if len(c) != 1 || c[0] != m.Arcs[0].Index {
+		t.Errorf("expected the arc at %d to be flagged, got %v", m.Arcs[0].Index, c)
+	}
+}
+
+func TestCheckToolReach(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG1F100Z-10\nX10\nZ-30\nX20\nG0Z5\n")
+	c := m.CheckToolReach(25)
+	if len(c) != 2 || m.Positions[c[0]].Z != -30 || m.Positions[c[1]].X != 20 {
+		t.Errorf("expected the two moves at Z-30 to be flagged, got %v", c)
+	}
+}
+
+func TestCheckSpindleOnDuringCut(t *testing.T) {
+	m := process(t, "G21G90\nM3S1000\nG0Z5\nG1F100Z-1\nX10\nM5\nY10\nX0\nM3\nY0\nG0Z5\n")
+	c := m.CheckSpindleOnDuringCut()
+	if len(c) != 1 {
+		t.Fatalf("expected one region, got %v", c)
+	}
+	if c[0].Error() != "Cutting with spindle disabled from position 4 to 5" {
+		t.Errorf("unexpected diagnostic: %s", c[0])
+	}
+}
+
+func TestCheckSpindleSpeedZero(t *testing.T) {
+	m := process(t, "G21G90\nM3S0\nG0Z5\nG1F100Z-1\nX10\nS1000\nY10\nM5\nS0\nX0\n")
+	c := m.CheckSpindleSpeedZero()
+	if len(c) != 2 || c[0] != 2 || c[1] != 3 {
+		t.Errorf("expected the cuts at 2 and 3 to be flagged, got %v", c)
+	}
+}
+
+func TestCheckSpindleToggleNoCut(t *testing.T) {
+	m := process(t, "G21G90\nM3S1000\nG0Z5\nG1F100Z-1\nX10\nG0Z5\nM5\nG0X100\nM3\nG0Y100\nM5\nG0X0Y0\n")
+	c := m.CheckSpindleToggleNoCut()
+	if len(c) != 2 || m.Positions[c[0]].Y != 100 || m.Positions[c[1]].Y != 0 {
+		t.Errorf("expected the spindle on during the reposition to be flagged, got %v", c)
+	}
+}
+
+func TestCheckUnreachableFeed(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG1F3000Z-1\nX10\nX10.1\n")
+	c := m.CheckUnreachableFeed(500)
+	if len(c) != 1 || m.Positions[c[0]].X != 10.1 {
+		t.Errorf("expected the 0.1mm move to be flagged, got %v", c)
+	}
+}
+
+func TestCheckEndsRetracted(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG1F100Z-1\nX10\n")
+	if err := m.CheckEndsRetracted(5); err == nil {
+		t.Fatal("expected an error for a program ending in the stock")
+	}
+
+	last := len(m.Positions) - 1
+	m.Return(true, true)
+	lift := m.Positions[last+1]
+	if lift.X != 10 || lift.Z != 5 || lift.State.MoveMode != MoveModeRapid {
+		t.Errorf("expected a lift to Z5 at X10, got %v", lift.Vector())
+	}
+	if err := m.CheckEndsRetracted(0); err != nil {
+		t.Errorf("unexpected error after Return: %s", err)
+	}
+}
+
+func TestCheckMaxMove(t *testing.T) {
+	m := process(t, "G21G90\nG0X100Y100\nX-300\nZ-50\n")
+	c := m.CheckMaxMove(300, 300, 0)
+	if len(c) != 1 || m.Positions[c[0]].X != -300 {
+		t.Errorf("expected the 400mm X move to be flagged, got %v", c)
+	}
+}
+
+func TestCheckSpindleVsTool(t *testing.T) {
+	src := "G21G90\nT1M6\nM3S20000\nG0Z5\nG1F100Z-1\nX10\nG0Z5\nT2M6\nG0X0\nG1Z-1\nX10\nG0Z5\n"
+	m := processWith(t, src, func(m *Machine) {
+		m.Tools = ToolTable{1: Tool{Diameter: 20}, 2: Tool{Diameter: 3}}
+	})
+	c := m.CheckSpindleVsTool(500)
+	if len(c) != 1 {
+		t.Fatalf("expected the 20mm tool at 20000 rpm to be flagged, got %v", c)
+	}
+	if !strings.HasPrefix(c[0].Error(), "Operation 0:") {
+		t.Errorf("unexpected diagnostic: %s", c[0])
+	}
+}
+
+func TestCheckContourGaps(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG1F100Z-1\nX10\nY10\nX0\nY0.05\nG0Z5\n")
+	c := m.CheckContourGaps(0.01)
+	if len(c) != 1 {
+		t.Errorf("expected the nearly closed loop to be flagged, got %v", c)
+	}
+	if c := m.CheckContourGaps(0.1); len(c) != 0 {
+		t.Errorf("expected the gap to be within 0.1, got %v", c)
+	}
+
+	closed := process(t, "G21G90\nG0Z5\nG1F100Z-1\nX10\nY10\nX0\nY0\nG0Z5\n")
+	if c := closed.CheckContourGaps(0.01); len(c) != 0 {
+		t.Errorf("expected no gaps, got %v", c)
+	}
+}
+
+func TestCheckFeedExceedsRapid(t *testing.T) {
+	m := process(t, "G21G90\nG0X10\nG1F5000X20\nF1000X30\n")
+	c := m.CheckFeedExceedsRapid(3000)
+	if len(c) != 1 || m.Positions[c[0]].X != 20 {
+		t.Errorf("expected the cut at 5000 mm/min to be flagged, got %v", c)
+	}
+}
+
+func TestCheckNoOpCuts(t *testing.T) {
+	m := process(t, "G21G90\nG1F100X10\nX10\nG0X10\nG1X20\n")
+	c := m.CheckNoOpCuts(1e-6)
+	if len(c) != 1 || c[0] != 2 {
+		t.Errorf("expected the zero-length cut at 2 to be flagged, got %v", c)
+	}
+}
+
+func TestCheckRedundantModals(t *testing.T) {
+	m := process(t, "G21G90\nG1F100X1\nG21X2\nG20X3\nG17\nG17X4\n")
+	expected := []int{2, 5}
+	r := m.CheckRedundantModals()
+	if len(r) != len(expected) {
+		t.Fatalf("expected blocks %v, got %v", expected, r)
+	}
+	for idx := range expected {
+		if r[idx] != expected[idx] {
+			t.Errorf("expected blocks %v, got %v", expected, r)
+		}
+	}
+
+	r[0] = 0
+	if r := m.CheckRedundantModals(); r[0] != expected[0] {
+		t.Error("redundant modals of the machine were modified through the result")
+	}
+}
+
+func TestCheckSpindleStartedBeforeCut(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG1F100Z-1\nX10\nM3S1000\nX20\nG0Z5\n")
+	if err := m.CheckSpindleStartedBeforeCut(); err == nil {
+		t.Error("expected an error for cutting before M3")
+	}
+	m = process(t, "G21G90\nG0Z5\nM3S1000\nG1F100Z-1\nX10\nM5\nG0Z5\n")
+	if err := m.CheckSpindleStartedBeforeCut(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestCheckCornerChipLoad(t *testing.T) {
+	// 0.05 mm per flute on the straights, but 0.005 mm after slowing for the second corner
+	m := process(t, "G21G90\nM3S10000\nG0X0Y0Z5\nG1F1000Z-1\nX10\nY10\nF100X0\nY0\n")
+	r := m.CheckCornerChipLoad(6, 2, 0.01)
+	expected := [][2]float64{{10, 10}, {0, 10}}
+	if len(r) != len(expected) {
+		t.Fatalf("expected %d corners, got %v", len(expected), r)
+	}
+	for idx, e := range expected {
+		if pos := m.Positions[r[idx]]; pos.X != e[0] || pos.Y != e[1] {
+			t.Errorf("expected a corner at X%v Y%v, got X%v Y%v", e[0], e[1], pos.X, pos.Y)
+		}
+	}
+
+	if r := m.CheckCornerChipLoad(6, 2, 0.001); len(r) != 0 {
+		t.Errorf("expected no corners below 0.001 mm, got %v", r)
+	}
+}
+
+func TestCheckSpindleSpeedConstancy(t *testing.T) {
+	m := process(t, "G21G90\nM3S1000\nG0Z5\nG1F100Z-1\nX10\nS2000X20\nG0Z5\nG0X30\nG1Z-1\nX40\nG0Z5\n")
+	r := m.CheckSpindleSpeedConstancy()
+	if len(r) != 1 {
+		t.Fatalf("expected 1 error, got %v", r)
+	}
+	if !strings.Contains(r[0].Error(), "Operation 0") {
+		t.Errorf("expected the first operation to be flagged, got %s", r[0])
+	}
+}
+
+func TestCheckRapidOverStock(t *testing.T) {
+	src := "G21G90\nG0Z5\nG0X0Y0\nG1F100Z-1\nX20\nY20\nX0\nY0\nG0Z1\n"
+	m := process(t, src+"G0X20Y20\nG0Z5\n")
+	if r := m.CheckRapidOverStock(0, 2); len(r) != 1 || m.Positions[r[0]].X != 20 || m.Positions[r[0]].Y != 20 {
+		t.Errorf("expected the rapid across the part to be flagged, got %v", r)
+	}
+	if r := m.CheckRapidOverStock(0, 0.5); len(r) != 0 {
+		t.Errorf("expected no rapids below a clearance of 0.5, got %v", r)
+	}
+
+	m = process(t, src+"G0X-5Y0\nG0X-5Y20\nG0Z5\n")
+	if r := m.CheckRapidOverStock(0, 2); len(r) != 0 {
+		t.Errorf("expected rapids outside the footprint to be allowed, got %v", r)
+	}
+}
@@ -26,6 +26,15 @@ func (c *CoordinateSystem) SetCoordinateSystem(x, y, z float64, s int) {
 	c.coordinateSystems[s] = vector.Vector{x, y, z}
 }
 
+func (c *CoordinateSystem) CurrentCoordinateSystem() int {
+	return c.currentCoordinateSystem
+}
+
+func (c *CoordinateSystem) StoredCoordinateSystem(s int) vector.Vector {
+	c.expandIfNecessary(s)
+	return c.coordinateSystems[s]
+}
+
 func (c *CoordinateSystem) SetOffset(x, y, z float64) {
 	c.offset.X = x
 	c.offset.Y = y
@@ -45,6 +54,13 @@ func (c *CoordinateSystem) EraseOffset() {
 	c.offsetEnabled = false
 }
 
+func (c *CoordinateSystem) ActiveOffset() vector.Vector {
+	if !c.offsetEnabled {
+		return vector.Vector{}
+	}
+	return c.offset
+}
+
 func (c *CoordinateSystem) GetCoordinateSystem() vector.Vector {
 	c.expandIfNecessary(c.currentCoordinateSystem)
 	if c.override {
@@ -0,0 +1,55 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/gcode"
+
+import "strconv"
+import "strings"
+
+//
+// Comment hints
+//
+// Supported hints:
+//
+//   (ARCFIT=n) - accept a radius deviation of up to n for the next arc
+//   (FEED n%)  - multiply the current and all following feedrates by n percent, replacing
+//                the previous FEED hint
+//
+
+// Applies hints from the comments of a block
+func (vm *Machine) commentHints(stmt *gcode.Block) {
+	for _, n := range stmt.Nodes {
+		c, ok := n.(*gcode.Comment)
+		if !ok {
+			continue
+		}
+		key, value, ok := splitHint(c.Content)
+		if !ok {
+			continue
+		}
+		switch key {
+		case "ARCFIT":
+			if v, err := strconv.ParseFloat(value, 64); err == nil && v > 0 {
+				vm.arcFitTolerance, _, _ = vm.axesToMetric(v, 0, 0)
+			}
+		case "FEED":
+			if !strings.HasSuffix(value, "%") {
+				continue
+			}
+			if v, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, "%")), 64); err == nil && v > 0 {
+				if vm.State.Feedrate > 0 {
+					vm.State.Feedrate *= v / 100 / vm.feedOverride
+				}
+				vm.feedOverride = v / 100
+			}
+		}
+	}
+}
+
+// Parses a "KEY=value" or "KEY value" hint
+func splitHint(c string) (key, value string, ok bool) {
+	c = strings.TrimSpace(c)
+	if idx := strings.IndexAny(c, "= "); idx > 0 {
+		return strings.ToUpper(strings.TrimSpace(c[:idx])), strings.TrimSpace(c[idx+1:]), true
+	}
+	return "", "", false
+}
@@ -0,0 +1,59 @@
+package vm
+
+import "testing"
+import "github.com/kennylevinsen/gocnc/gcode"
+
+// Processes src on a fresh machine, returning the error
+func processErr(t *testing.T, src string) error {
+	doc, err := gcode.Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Machine
+	m.Init()
+	return m.Process(doc)
+}
+
+func TestArcFitHint(t *testing.T) {
+	arc := "G3X0Y10.3I-10J0\n"
+	if err := processErr(t, "G21G90\nG1F100X10Y0\n"+arc); err == nil {
+		t.Fatal("expected the sloppy arc to be rejected")
+	}
+	if err := processErr(t, "G21G90\nG1F100X10Y0\n(ARCFIT=0.5)\n"+arc); err != nil {
+		t.Errorf("expected the hint to accept the arc, got %s", err)
+	}
+	if err := processErr(t, "G21G90\nG1F100X10Y0\n(ARCFIT=0.1)\n"+arc); err == nil {
+		t.Error("expected the arc to exceed the hinted tolerance")
+	}
+
+	// The hint only applies to the next arc
+	if err := processErr(t, "G21G90\nG1F100X10Y0\n(ARCFIT=0.5)\n"+arc+"G1X10Y0\n"+arc); err == nil {
+		t.Error("expected the second arc to be rejected")
+	}
+}
+
+func TestFeedHint(t *testing.T) {
+	m := process(t, "G21G90\nG1F200X1\n(FEED 50%)\nX2\nF300X3\n(FEED 100%)\nX4\n")
+	expected := []struct {
+		x, feed float64
+	}{
+		{1, 200},
+		{2, 100},
+		{3, 150},
+		{4, 300},
+	}
+	for _, e := range expected {
+		found := false
+		for _, pos := range m.Positions {
+			if pos.State.MoveMode == MoveModeLinear && pos.X == e.x {
+				found = true
+				if pos.State.Feedrate != e.feed {
+					t.Errorf("X%g: expected F%g, got F%g", e.x, e.feed, pos.State.Feedrate)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("X%g: move not found", e.x)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 import "github.com/kennylevinsen/gocnc/vector"
 import "fmt"
 import "errors"
+import "math"
 
 //
 // The CNC interpreter/"vm"
@@ -20,6 +21,7 @@ import "errors"
 //   G03   - ccw arc
 //   G04   - dwell
 //   G10L2 - set coordinate system offsets
+//   G10L20 - set coordinate system offsets relative to current position
 //   G17   - xy arc plane
 //   G18   - xz arc plane
 //   G19   - yz arc plane
@@ -29,6 +31,10 @@ import "errors"
 //   G28.1 - set predefined position 1
 //   G30   - go to predefined position 2
 //   G30.1 - set predefined position 2
+//   G38.2 - probe toward workpiece, error on failure
+//   G38.3 - probe toward workpiece
+//   G38.4 - probe away from workpiece, error on failure
+//   G38.5 - probe away from workpiece
 //   G40   - cutter compensation
 //   G41   - cutter compensation
 //   G42   - cutter compensation
@@ -42,6 +48,9 @@ import "errors"
 //   G59.1 - select coordinate system 7
 //   G59.2 - select coordinate system 8
 //   G59.3 - select coordinate system 9
+//   G61   - exact path mode
+//   G61.1 - exact stop mode
+//   G64   - path blending, with optional P and Q tolerances
 //   G80   - cancel mode (?)
 //   G90   - absolute
 //   G90.1 - absolute arc
@@ -54,6 +63,8 @@ import "errors"
 //   G93   - inverse feed mode
 //   G94   - units per minute feed mode
 //   G95   - units per revolution feed mode
+//   G98   - canned cycle retract to initial height
+//   G99   - canned cycle retract to R height
 //
 //   M02 - end of program
 //   M03 - spindle enable clockwise
@@ -63,6 +74,7 @@ import "errors"
 //   M07 - mist coolant enable
 //   M08 - flood coolant enable
 //   M09 - coolant disable
+//   M19 - spindle orientation
 //   M30 - end of program
 //
 //   F - feedrate
@@ -74,6 +86,7 @@ import "errors"
 //
 // Notes:
 //   Cutter compensation is just passed to machine
+//   Probes are recorded with their target, and moves after them assume it was reached
 //
 
 //
@@ -100,6 +113,16 @@ const (
 	MoveModeCWArc  = iota
 	MoveModeCCWArc = iota
 	MoveModeDwell  = iota
+	MoveModeOrient = iota
+	MoveModeProbe  = iota
+)
+
+// Constants for probe mode
+const (
+	ProbeModeTowardError = iota
+	ProbeModeToward      = iota
+	ProbeModeAwayError   = iota
+	ProbeModeAway        = iota
 )
 
 // Constants for plane selection
@@ -109,6 +132,15 @@ const (
 	PlaneYZ = iota
 )
 
+// Axes
+type Axis int
+
+const (
+	AxisX Axis = iota
+	AxisY Axis = iota
+	AxisZ Axis = iota
+)
+
 // Constants for feedrate mode
 const (
 	FeedModeUnitsMin = iota
@@ -138,6 +170,8 @@ type State struct {
 	ToolLengthIndex    int
 	CutterCompensation int
 	DwellTime          float64
+	RetractToInitial   bool
+	ProbeMode          int
 }
 
 // NewState returns an initialized State.
@@ -148,6 +182,7 @@ func NewState() State {
 		NextToolIndex:      -1,
 		ToolLengthIndex:    -1,
 		CutterCompensation: -1,
+		RetractToInitial:   true,
 	}
 }
 
@@ -157,10 +192,40 @@ type Position struct {
 	X, Y, Z float64
 }
 
+// NewPosition returns a Position with the given state and coordinates.
+// An error is returned if any coordinate is NaN or infinite.
+func NewPosition(state State, x, y, z float64) (Position, error) {
+	for _, v := range []float64{x, y, z} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return Position{}, errors.New(fmt.Sprintf("Invalid coordinate: %g", v))
+		}
+	}
+	return Position{State: state, X: x, Y: y, Z: z}, nil
+}
+
 func (p Position) Vector() vector.Vector {
 	return vector.Vector{p.X, p.Y, p.Z}
 }
 
+// Arc as programmed, recorded before linearization
+type Arc struct {
+	Index        int // Position index of the first linearized segment
+	End          int // Position index of the end point
+	Plane        int
+	PlaneChanged bool // Plane was changed since the previous move
+	Clockwise    bool
+	Sweep        float64 // Radians, including additional rotations
+	Segments     int     // Number of linear segments the arc was approximated by
+}
+
+// Radius verification of an arc, as recorded with VerboseArcs
+type ArcDeviation struct {
+	Start, End, Center     vector.Vector
+	StartRadius, EndRadius float64
+	Deviation              float64 // Absolute radius difference (mm)
+	Percent                float64 // Radius difference relative to StartRadius
+}
+
 // Machine state and settings
 type Machine struct {
 	State     State
@@ -172,6 +237,7 @@ type Machine struct {
 	AbsoluteMove bool
 	AbsoluteArc  bool
 	MovePlane    int
+	planeChanged bool
 
 	// Coordinate systems
 	CoordinateSystem CoordinateSystem
@@ -181,12 +247,40 @@ type Machine struct {
 	StoredPos2 vector.Vector
 
 	// Arc settings
-	MaxArcDeviation  float64
-	MinArcLineLength float64
+	MaxArcDeviation     float64
+	MinArcLineLength    float64
+	ArcSegmentsOverride int     // Fixed segment count per arc, if > 0
+	arcFitTolerance     float64 // Radius deviation accepted for the next arc, if > 0
+
+	// Path blending settings, as last given by G64
+	BlendTolerance    float64 // P, or 0 if not given
+	NaiveCamTolerance float64 // Q, or 0 if not given
+
+	// Feedrate multiplier, as last given by a FEED n% hint
+	feedOverride float64
+
+	// Stock settings
+	StockTop float64
+
+	// Tool settings
+	Tools         ToolTable  // Tool definitions, such as from ParseToolComments
+	ToolChangePos [3]float64 // X, Y and Z to perform tool changes at
 
 	// Options
 	IgnoreBlockDelete   bool
 	AllowRemainingWords bool
+	LaserMode           bool // S is laser power, and M3/M5 toggle the beam
+	VerboseArcs         bool // Record ArcDeviations for every arc, including failing ones
+
+	// Diagnostics
+	Arcs                 []Arc
+	ArcDeviations        []ArcDeviation
+	redundantToolChanges []int
+	redundantModals      []int
+	history              []string
+	assertedModals       map[string]bool
+	blockIndex           int
+	block                string // The block being processed, as it was before processing
 }
 
 //
@@ -219,6 +313,19 @@ func (vm *Machine) programName(stmt *gcode.Block) {
 	}
 }
 
+// Records that a modal group was set, noting the block if it was set before to the same value
+func (vm *Machine) assertModal(group string, changed bool) {
+	if vm.assertedModals == nil {
+		vm.assertedModals = make(map[string]bool)
+	}
+	if vm.assertedModals[group] && !changed {
+		if n := len(vm.redundantModals); n == 0 || vm.redundantModals[n-1] != vm.blockIndex {
+			vm.redundantModals = append(vm.redundantModals, vm.blockIndex)
+		}
+	}
+	vm.assertedModals[group] = true
+}
+
 func (vm *Machine) feedRateMode(stmt *gcode.Block) {
 	if w, err := stmt.GetModalGroup("feedRateModeGroup"); err == nil {
 		if w != nil {
@@ -237,6 +344,7 @@ func (vm *Machine) feedRateMode(stmt *gcode.Block) {
 			default:
 				unknownCommand("feedRateModeGroup", w)
 			}
+			vm.assertModal("feedRateModeGroup", vm.State.FeedMode != oldMode)
 			if vm.State.FeedMode != oldMode {
 				// Ensure that feedrate is cleared
 				vm.State.Feedrate = 0
@@ -254,7 +362,7 @@ func (vm *Machine) feedRate(stmt *gcode.Block) {
 		if vm.Imperial {
 			val *= 25.4
 		}
-		vm.State.Feedrate = val
+		vm.State.Feedrate = val * vm.feedOverride
 		stmt.RemoveAddress('F')
 	} else if vm.State.FeedMode == FeedModeInvTime {
 		vm.State.Feedrate = -1
@@ -287,6 +395,9 @@ func (vm *Machine) toolChange(stmt *gcode.Block) {
 				if vm.State.NextToolIndex == -1 {
 					panic("Toolchange attempted without a defined tool")
 				}
+				if vm.State.ToolIndex == vm.State.NextToolIndex {
+					vm.redundantToolChanges = append(vm.redundantToolChanges, len(vm.Positions))
+				}
 				vm.State.ToolIndex = vm.State.NextToolIndex
 			default:
 				unknownCommand("toolChangeGroup", w)
@@ -315,6 +426,9 @@ func (vm *Machine) setSpindle(stmt *gcode.Block) {
 				vm.State.SpindleClockwise = false
 			case 5:
 				vm.State.SpindleEnabled = false
+			case 19:
+				vm.State.SpindleEnabled = false
+				vm.orient()
 			default:
 				unknownCommand("spindleGroup", w)
 			}
@@ -359,6 +473,7 @@ func (vm *Machine) setPlane(stmt *gcode.Block) {
 				unknownCommand("planeSelectionGroup", w)
 			}
 
+			oldPlane := vm.MovePlane
 			switch w.Command {
 			case 17:
 				vm.MovePlane = PlaneXY
@@ -369,6 +484,37 @@ func (vm *Machine) setPlane(stmt *gcode.Block) {
 			default:
 				unknownCommand("planeSelectionGroup", w)
 			}
+			if vm.MovePlane != oldPlane {
+				vm.planeChanged = true
+			}
+			vm.assertModal("planeSelectionGroup", vm.MovePlane != oldPlane)
+			stmt.Remove(w)
+		}
+	} else {
+		propagate(err)
+	}
+}
+
+func (vm *Machine) setControlMode(stmt *gcode.Block) {
+	if w, err := stmt.GetModalGroup("controlModeGroup"); err == nil {
+		if w != nil {
+			if w.Address != 'G' {
+				unknownCommand("controlModeGroup", w)
+			}
+
+			switch w.Command {
+			case 61, 61.1:
+			case 64:
+				if p, err := stmt.GetWord('P'); err == nil {
+					vm.BlendTolerance, _, _ = vm.axesToMetric(p, 0, 0)
+				}
+				if q, err := stmt.GetWord('Q'); err == nil {
+					vm.NaiveCamTolerance, _, _ = vm.axesToMetric(q, 0, 0)
+				}
+				stmt.RemoveAddress('P', 'Q')
+			default:
+				unknownCommand("controlModeGroup", w)
+			}
 			stmt.Remove(w)
 		}
 	} else {
@@ -404,6 +550,7 @@ func (vm *Machine) setUnits(stmt *gcode.Block) {
 				unknownCommand("unitsGroup", w)
 			}
 
+			old := vm.Imperial
 			switch w.Command {
 			case 20:
 				vm.Imperial = true
@@ -412,6 +559,7 @@ func (vm *Machine) setUnits(stmt *gcode.Block) {
 			default:
 				unknownCommand("unitsGroup", w)
 			}
+			vm.assertModal("unitsGroup", vm.Imperial != old)
 			stmt.Remove(w)
 		}
 	} else {
@@ -478,7 +626,7 @@ func (vm *Machine) setCoordinateSystem(stmt *gcode.Block) {
 				unknownCommand("coordinateSystemGroup", w)
 			}
 
-			if vm.State.CutterCompensation != CutCompModeNone {
+			if vm.State.CutterCompensation > CutCompModeNone {
 				invalidCommand("coordinateSystemGroup", "coordinate system select", "Coordinate system change attempted with cutter compensation enabled")
 			}
 
@@ -519,6 +667,7 @@ func (vm *Machine) setDistanceMode(stmt *gcode.Block) {
 				unknownCommand("distanceModeGroup", w)
 			}
 
+			old := vm.AbsoluteMove
 			switch w.Command {
 			case 90:
 				vm.AbsoluteMove = true
@@ -527,6 +676,7 @@ func (vm *Machine) setDistanceMode(stmt *gcode.Block) {
 			default:
 				unknownCommand("distanceModeGroup", w)
 			}
+			vm.assertModal("distanceModeGroup", vm.AbsoluteMove != old)
 			stmt.Remove(w)
 		}
 	} else {
@@ -541,6 +691,7 @@ func (vm *Machine) setArcDistanceMode(stmt *gcode.Block) {
 				unknownCommand("arcDistanceModeGroup", w)
 			}
 
+			old := vm.AbsoluteArc
 			switch w.Command {
 			case 90.1:
 				vm.AbsoluteArc = true
@@ -549,6 +700,29 @@ func (vm *Machine) setArcDistanceMode(stmt *gcode.Block) {
 			default:
 				unknownCommand("arcDistanceModeGroup", w)
 			}
+			vm.assertModal("arcDistanceModeGroup", vm.AbsoluteArc != old)
+			stmt.Remove(w)
+		}
+	} else {
+		propagate(err)
+	}
+}
+
+func (vm *Machine) setRetractMode(stmt *gcode.Block) {
+	if w, err := stmt.GetModalGroup("cannedCyclesModeGroup"); err == nil {
+		if w != nil {
+			if w.Address != 'G' {
+				unknownCommand("cannedCyclesModeGroup", w)
+			}
+
+			switch w.Command {
+			case 98:
+				vm.State.RetractToInitial = true
+			case 99:
+				vm.State.RetractToInitial = false
+			default:
+				unknownCommand("cannedCyclesModeGroup", w)
+			}
 			stmt.Remove(w)
 		}
 	} else {
@@ -577,19 +751,16 @@ func (vm *Machine) nonModals(stmt *gcode.Block) {
 
 			case 10:
 				if val, err := stmt.GetWord('L'); err == nil {
-					if val == 2 {
+					if val == 2 || val == 20 {
 						// Set coordinate system offsets
 						if cs, err := stmt.GetWord('P'); err == nil {
-							cs := int(cs)
-							x, y, z := stmt.GetWordDefault('X', 0), stmt.GetWordDefault('Y', 0), stmt.GetWordDefault('Z', 0)
-							x, y, z = vm.axesToMetric(x, y, z)
-
-							vm.CoordinateSystem.SetCoordinateSystem(x, y, z, cs)
-							stmt.RemoveAddress('X', 'Y', 'Z')
+							vm.setCoordinateSystemOffsets(stmt, int(cs), val == 20)
 						} else {
 							invalidCommand("nonModalGroup", "coordinate system configuration", "P word not specified or specified multiple times")
 						}
 						stmt.RemoveAddress('P')
+					} else {
+						invalidCommand("nonModalGroup", "G10 configuration", fmt.Sprintf("L%g not supported", val))
 					}
 				} else {
 					invalidCommand("nonModalGroup", "G10 configuration", "L word not specified or specified multiple times")
@@ -682,6 +853,18 @@ func (vm *Machine) setMoveMode(stmt *gcode.Block) {
 				vm.State.MoveMode = MoveModeCWArc
 			case 3:
 				vm.State.MoveMode = MoveModeCCWArc
+			case 38.2:
+				vm.State.MoveMode = MoveModeProbe
+				vm.State.ProbeMode = ProbeModeTowardError
+			case 38.3:
+				vm.State.MoveMode = MoveModeProbe
+				vm.State.ProbeMode = ProbeModeToward
+			case 38.4:
+				vm.State.MoveMode = MoveModeProbe
+				vm.State.ProbeMode = ProbeModeAwayError
+			case 38.5:
+				vm.State.MoveMode = MoveModeProbe
+				vm.State.ProbeMode = ProbeModeAway
 			case 80:
 				vm.State.MoveMode = MoveModeNone
 			default:
@@ -707,7 +890,7 @@ func (vm *Machine) performMove(stmt *gcode.Block) {
 	}
 
 	if vm.CoordinateSystem.OverrideActive() {
-		if s.CutterCompensation != CutCompModeNone {
+		if s.CutterCompensation > CutCompModeNone {
 			invalidCommand("motionGroup", "move", "Coordinate override attempted with cutter compensation enabled")
 		}
 
@@ -728,6 +911,15 @@ func (vm *Machine) performMove(stmt *gcode.Block) {
 		vm.move(newX, newY, newZ)
 		stmt.RemoveAddress('X', 'Y', 'Z')
 
+	} else if s.MoveMode == MoveModeProbe {
+		// Probe, recorded with its target, as the point of contact is unknown
+		if s.CutterCompensation > CutCompModeNone {
+			invalidCommand("motionGroup", "probe", "Probe attempted with cutter compensation enabled")
+		}
+		newX, newY, newZ, _, _, _ := vm.calcPos(*stmt)
+		vm.move(newX, newY, newZ)
+		stmt.RemoveAddress('X', 'Y', 'Z')
+
 	} else {
 		invalidCommand("motionGroup", "move", fmt.Sprintf("Move attempted without an active move mode [%s]", stmt.Export(-1)))
 	}
@@ -797,11 +989,14 @@ func (vm *Machine) run(stmt gcode.Block) (err error) {
 	vm.setPolarMode(&stmt)
 	vm.setPlane(&stmt)
 	vm.setUnits(&stmt)
+	vm.commentHints(&stmt)
 	vm.setCutterCompensation(&stmt)
 	vm.setToolLength(&stmt)
 	vm.setCoordinateSystem(&stmt)
 	vm.setDistanceMode(&stmt)
 	vm.setArcDistanceMode(&stmt)
+	vm.setRetractMode(&stmt)
+	vm.setControlMode(&stmt)
 	vm.nonModals(&stmt)
 	vm.setMoveMode(&stmt)
 	vm.performMove(&stmt)
@@ -821,21 +1016,47 @@ func (vm *Machine) finalize() {
 	}
 }
 
-// Process AST
+// Error from processing a block
+type ProcessError struct {
+	Line  int    // Line of the block in the document, counting from 1
+	Block string // The block, as it was before processing
+	Err   error
+}
+
+func (e *ProcessError) Error() string {
+	return fmt.Sprintf("line %d [%s]: %s", e.Line, e.Block, e.Err)
+}
+
+// Process AST.
+// Errors from blocks are returned as *ProcessError.
 func (vm *Machine) Process(doc *gcode.Document) (err error) {
 	for idx, b := range doc.Blocks {
 		if b.BlockDelete && vm.IgnoreBlockDelete {
 			continue
 		}
 
+		// Processing consumes the words of the block, so export it first
+		vm.blockIndex, vm.block = idx, b.Export(-1)
 		if err := vm.run(b); err != nil {
-			return errors.New(fmt.Sprintf("line %d: %s", idx+1, err))
+			return &ProcessError{Line: idx + 1, Block: vm.block, Err: err}
 		}
 	}
 	vm.finalize()
 	return nil
 }
 
+// Process AST, converting any failure into an error.
+// Errors from blocks, including panics while processing them, are returned as *ProcessError.
+func (vm *Machine) SafeProcess(doc *gcode.Document) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &ProcessError{Line: vm.blockIndex + 1, Block: vm.block, Err: fmt.Errorf("%v", r)}
+		}
+	}()
+
+	return vm.Process(doc)
+}
+
 // Initialize the VM to sane default values
 func (vm *Machine) Init() {
 	vm.State = NewState()
@@ -844,8 +1065,11 @@ func (vm *Machine) Init() {
 	vm.AbsoluteMove = true
 	vm.AbsoluteArc = false
 	vm.MovePlane = PlaneXY
+	vm.CoordinateSystem.SelectCoordinateSystem(1)
 	vm.MaxArcDeviation = 0.002
 	vm.MinArcLineLength = 0.01
+	vm.feedOverride = 1
+	vm.StockTop = 0
 	vm.IgnoreBlockDelete = false
 }
 
@@ -866,6 +1090,12 @@ func (m *Position) Dump() {
 		fmt.Printf("Clockwise arc\n")
 	case MoveModeCCWArc:
 		fmt.Printf("Counterclockwise arc\n")
+	case MoveModeDwell:
+		fmt.Printf("Dwell\n")
+	case MoveModeOrient:
+		fmt.Printf("Spindle orientation\n")
+	case MoveModeProbe:
+		fmt.Printf("Probe\n")
 	}
 	fmt.Printf("   Tool: %d, Tool length: %d, Next tool: %d\n", m.State.ToolIndex, m.State.ToolLengthIndex, m.State.NextToolIndex)
 	fmt.Printf("   Feedrate: %g\n", m.State.Feedrate)
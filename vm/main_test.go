@@ -0,0 +1,113 @@
+package vm
+
+import "math"
+import "strings"
+import "testing"
+import "github.com/kennylevinsen/gocnc/gcode"
+
+// Parses and processes src on a fresh machine
+func process(t *testing.T, src string) *Machine {
+	return processWith(t, src, func(*Machine) {})
+}
+
+// Parses and processes src on a fresh machine, configured by setup before processing
+func processWith(t *testing.T, src string, setup func(*Machine)) *Machine {
+	doc, err := gcode.Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Machine
+	m.Init()
+	setup(&m)
+	if err := m.Process(doc); err != nil {
+		t.Fatal(err)
+	}
+	return &m
+}
+
+func TestSafeProcessNaN(t *testing.T) {
+	big := strings.Repeat("9", 308)
+	doc, err := gcode.Parse("G20G91\nG1F100X" + big + "\nX-" + big + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := doc.Blocks[2].Export(-1)
+	var m Machine
+	m.Init()
+	err = m.SafeProcess(doc)
+	if err == nil {
+		t.Fatal("expected an error from a NaN move")
+	}
+	if !strings.Contains(err.Error(), "NaN") {
+		t.Errorf("unexpected error: %s", err)
+	}
+	perr, ok := err.(*ProcessError)
+	if !ok {
+		t.Fatalf("expected a *ProcessError, got %T", err)
+	}
+	if perr.Line != 3 || perr.Block != block {
+		t.Errorf("expected line 3 [%s], got line %d [%s]", block, perr.Line, perr.Block)
+	}
+}
+
+func TestProcessErrorLine(t *testing.T) {
+	doc, err := gcode.Parse("G21G90\nG1F100X1\nG2X2Y0I0J0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Machine
+	m.Init()
+	err = m.Process(doc)
+	perr, ok := err.(*ProcessError)
+	if !ok {
+		t.Fatalf("expected a *ProcessError, got %T: %v", err, err)
+	}
+	if perr.Line != 3 {
+		t.Errorf("expected line 3, got %d", perr.Line)
+	}
+	if perr.Block != "G2X2Y0I0J0" {
+		t.Errorf("unexpected block: %s", perr.Block)
+	}
+}
+
+func TestRetractMode(t *testing.T) {
+	m := process(t, "G21G90\nG1F100X1\nG99\nX2\nX3\nG98\nX4\n")
+	expected := []bool{true, true, false, false, true}
+	if len(m.Positions) < len(expected) {
+		t.Fatalf("expected at least %d positions, got %d", len(expected), len(m.Positions))
+	}
+	for idx, e := range expected {
+		if m.Positions[idx].State.RetractToInitial != e {
+			t.Errorf("position %d: expected RetractToInitial %v", idx, e)
+		}
+	}
+}
+
+func TestNewPosition(t *testing.T) {
+	p, err := NewPosition(NewState(), 1, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.X != 1 || p.Y != 2 || p.Z != 3 || p.State != NewState() {
+		t.Errorf("unexpected position: %+v", p)
+	}
+	for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if _, err := NewPosition(NewState(), 0, v, 0); err == nil {
+			t.Errorf("expected an error for %f", v)
+		}
+	}
+}
+
+func TestRotaryWordsRejected(t *testing.T) {
+	// There is no rotary axis to unwrap, so A words must not be silently dropped
+	doc, err := gcode.Parse("G21G90\nG0X1A350\nG0A10\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Machine
+	m.Init()
+	err = m.Process(doc)
+	if err == nil || !strings.Contains(err.Error(), "A350") {
+		t.Errorf("expected the A word to be rejected, got %v", err)
+	}
+}
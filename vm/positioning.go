@@ -1,6 +1,7 @@
 package vm
 
 import "github.com/kennylevinsen/gocnc/gcode"
+import "github.com/kennylevinsen/gocnc/vector"
 import "math"
 import "fmt"
 
@@ -26,6 +27,41 @@ func (vm *Machine) move(x, y, z float64) {
 	}
 	pos := Position{vm.State, x, y, z}
 	vm.Positions = append(vm.Positions, pos)
+	vm.planeChanged = false
+}
+
+// Sets coordinate system offsets from a G10 L2/L20 block. Axes without words are left as they were.
+// If relative, the offsets are calculated so that the current position gets the given coordinates.
+func (vm *Machine) setCoordinateSystemOffsets(stmt *gcode.Block, cs int, relative bool) {
+	if cs == 0 {
+		cs = vm.CoordinateSystem.CurrentCoordinateSystem()
+	} else if cs < 1 || cs > 9 {
+		invalidCommand("nonModalGroup", "coordinate system configuration", fmt.Sprintf("P%d is not a coordinate system", cs))
+	}
+
+	pos := vm.curPos()
+	offset := vm.CoordinateSystem.ActiveOffset()
+	v := vm.CoordinateSystem.StoredCoordinateSystem(cs)
+
+	set := func(address rune, cur, off float64, dst *float64) {
+		if val, err := stmt.GetWord(address); err == nil {
+			if vm.Imperial {
+				val *= 25.4
+			}
+			if relative {
+				*dst = cur - val - off
+			} else {
+				*dst = val
+			}
+		}
+	}
+
+	set('X', pos.X, offset.X, &v.X)
+	set('Y', pos.Y, offset.Y, &v.Y)
+	set('Z', pos.Z, offset.Z, &v.Z)
+
+	vm.CoordinateSystem.SetCoordinateSystem(v.X, v.Y, v.Z, cs)
+	stmt.RemoveAddress('X', 'Y', 'Z')
 }
 
 // Calculates the absolute position of the given statement, including optional I, J, K parameters.
@@ -160,7 +196,24 @@ func (vm *Machine) arc(x, y, z, i, j, k, rotations float64) {
 	deviation := math.Abs((radius2-radius1)/radius1) * 100
 	rDiff := math.Abs(radius2 - radius1)
 
-	if (rDiff > 0.005 && deviation > 0.1) || rDiff > 0.5 {
+	if vm.VerboseArcs {
+		vm.ArcDeviations = append(vm.ArcDeviations, ArcDeviation{
+			Start:       sp.Vector(),
+			End:         vector.Vector{x, y, z},
+			Center:      vector.Vector{i, j, k},
+			StartRadius: radius1,
+			EndRadius:   radius2,
+			Deviation:   rDiff,
+			Percent:     deviation,
+		})
+	}
+
+	if vm.arcFitTolerance > 0 {
+		if rDiff > vm.arcFitTolerance {
+			panic(fmt.Sprintf("Radius deviation of %f mm exceeds hinted tolerance of %f mm", rDiff, vm.arcFitTolerance))
+		}
+		vm.arcFitTolerance = 0
+	} else if (rDiff > 0.005 && deviation > 0.1) || rDiff > 0.5 {
 		panic(fmt.Sprintf("Radius deviation of %f percent and %f mm", deviation, rDiff))
 	}
 
@@ -183,6 +236,14 @@ func (vm *Machine) arc(x, y, z, i, j, k, rotations float64) {
 		angleDiff += rotations * 2 * math.Pi
 	}
 
+	vm.Arcs = append(vm.Arcs, Arc{
+		Index:        len(vm.Positions),
+		Plane:        vm.MovePlane,
+		PlaneChanged: vm.planeChanged,
+		Clockwise:    clockwise,
+		Sweep:        math.Abs(angleDiff),
+	})
+
 	steps := 1
 
 	// Enforce a maximum arc deviation
@@ -198,6 +259,16 @@ func (vm *Machine) arc(x, y, z, i, j, k, rotations float64) {
 		steps = steps2
 	}
 
+	if vm.ArcSegmentsOverride > 0 {
+		steps = vm.ArcSegmentsOverride
+	}
+
+	if steps > 1 {
+		vm.Arcs[len(vm.Arcs)-1].Segments = steps
+	} else {
+		vm.Arcs[len(vm.Arcs)-1].Segments = 1
+	}
+
 	angle := 0.0
 
 	// Execute arc approximation
@@ -211,6 +282,15 @@ func (vm *Machine) arc(x, y, z, i, j, k, rotations float64) {
 	}
 
 	add(e1, e2, e3)
+	vm.Arcs[len(vm.Arcs)-1].End = len(vm.Positions) - 1
+}
+
+// Appends a spindle orientation marker at the current position
+func (vm *Machine) orient() {
+	curPos := vm.curPos()
+	curPos.State = vm.State
+	curPos.State.MoveMode = MoveModeOrient
+	vm.Positions = append(vm.Positions, curPos)
 }
 
 func (vm *Machine) dwell(seconds float64) {
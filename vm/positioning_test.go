@@ -0,0 +1,83 @@
+package vm
+
+import "math"
+import "testing"
+import "github.com/kennylevinsen/gocnc/gcode"
+
+func TestG10WorkOffsets(t *testing.T) {
+	m := process(t, "G21G90G54\nG10L2P1X10Y20\nG0X1Y1Z1\nG10L2P1Z5\nG0X0Y0Z0\nG10L20P2X0Y0Z0\nG55\nG0X1Y2Z3\n")
+	expected := [][3]float64{{11, 21, 1}, {10, 20, 5}, {11, 22, 8}}
+	var got [][3]float64
+	for _, pos := range m.Positions[1:] {
+		got = append(got, [3]float64{pos.X, pos.Y, pos.Z})
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d positions, got %v", len(expected), got)
+	}
+	for idx := range expected {
+		if got[idx] != expected[idx] {
+			t.Errorf("position %d: expected %v, got %v", idx+1, expected[idx], got[idx])
+		}
+	}
+}
+
+func TestArcSegmentsOverride(t *testing.T) {
+	m := processWith(t, "G21G90\nG1F100X10Y0\nG3X0Y10I-10J0\n", func(m *Machine) {
+		m.ArcSegmentsOverride = 8
+	})
+	a := m.Arcs[0]
+	if a.Segments != 8 {
+		t.Errorf("expected 8 segments, got %d", a.Segments)
+	}
+	// The start, 8 segments and the end point
+	if n := a.End - a.Index + 1; n != 10 {
+		t.Errorf("expected 10 arc positions, got %d", n)
+	}
+}
+
+func TestVerboseArcs(t *testing.T) {
+	src := "G21G90\nG1F100X10Y0\nG3X0Y10.002I-10J0\n"
+	m := processWith(t, src, func(m *Machine) {
+		m.VerboseArcs = true
+	})
+	if len(m.ArcDeviations) != 1 {
+		t.Fatalf("expected one arc deviation, got %d", len(m.ArcDeviations))
+	}
+	d := m.ArcDeviations[0]
+	if d.StartRadius != 10 || math.Abs(d.EndRadius-10.002) > 1e-9 || math.Abs(d.Deviation-0.002) > 1e-9 {
+		t.Errorf("unexpected deviation: %+v", d)
+	}
+	if math.Abs(d.Percent-0.02) > 1e-9 {
+		t.Errorf("expected 0.02 percent, got %f", d.Percent)
+	}
+
+	if m := process(t, src); len(m.ArcDeviations) != 0 {
+		t.Errorf("expected no deviations without VerboseArcs, got %d", len(m.ArcDeviations))
+	}
+}
+
+func TestCoordinateSystemDefaults(t *testing.T) {
+	// Cutter compensation is unknown until G40, which must not block G54
+	m := process(t, "G21G90G54\nG10L2P1X10\nG0X1\n")
+	if p := m.Positions[len(m.Positions)-1]; p.X != 11 {
+		t.Errorf("expected X11 in G54, got %v", p.Vector())
+	}
+
+	// G54 is active from the start, so P0 sets it
+	m = process(t, "G21G90\nG10L2P0Y10\nG0Y1\nG54\nG0Y2\n")
+	for idx, y := range []float64{11, 12} {
+		if p := m.Positions[idx+1]; p.Y != y {
+			t.Errorf("position %d: expected Y%g, got %v", idx+1, y, p.Vector())
+		}
+	}
+
+	doc, err := gcode.Parse("G21G90G42\nG54\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c Machine
+	c.Init()
+	if err := c.Process(doc); err == nil {
+		t.Errorf("expected G54 with cutter compensation enabled to fail")
+	}
+}
@@ -0,0 +1,55 @@
+package vm
+
+import "fmt"
+import "io"
+
+// Writes the cutting moves as an SVG image of the XY plane, with every Z layer (as by LayersByZ)
+// as a separate group. Layers are colored from blue at the highest to red at the deepest.
+func (vm *Machine) WriteLayeredSVG(w io.Writer, epsilon float64) error {
+	layers := vm.layerIndexes(epsilon)
+	minx, miny, _, maxx, maxy, _ := extents(vm.Positions)
+	width, height := maxx-minx, maxy-miny
+
+	var minz, maxz float64
+	for idx, layer := range layers {
+		z := vm.Positions[layer[0]].Z
+		if idx == 0 || z < minz {
+			minz = z
+		}
+		if idx == 0 || z > maxz {
+			maxz = z
+		}
+	}
+
+	if _, err := fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" viewBox=\"%g %g %g %g\">\n", minx, 0.0, width, height); err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		z := vm.Positions[layer[0]].Z
+		depth := 0.0
+		if maxz > minz {
+			depth = (maxz - z) / (maxz - minz)
+		}
+		color := fmt.Sprintf("#%02x00%02x", int(255*depth), int(255*(1-depth)))
+
+		if _, err := fmt.Fprintf(w, "<g stroke=\"%s\" fill=\"none\" data-z=\"%g\">\n", color, z); err != nil {
+			return err
+		}
+		for _, idx := range layer {
+			if idx == 0 {
+				continue
+			}
+			a, b := vm.Positions[idx-1], vm.Positions[idx]
+			if _, err := fmt.Fprintf(w, "<line x1=\"%g\" y1=\"%g\" x2=\"%g\" y2=\"%g\"/>\n", a.X, maxy-a.Y, b.X, maxy-b.Y); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "</g>\n"); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "</svg>\n")
+	return err
+}
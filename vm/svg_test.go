@@ -0,0 +1,25 @@
+package vm
+
+import "bytes"
+import "strings"
+import "testing"
+
+func TestWriteLayeredSVG(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG1F100Z-1\nX10\nY10\nG0Z5\nX0Y0\nG1Z-2\nX10\nG0Z5\nX0Y0\nG1Z-3\nX10\nG0Z5\n")
+	var b bytes.Buffer
+	if err := m.WriteLayeredSVG(&b, 1e-6); err != nil {
+		t.Fatal(err)
+	}
+	svg := b.String()
+	if n := strings.Count(svg, "<g "); n != 3 {
+		t.Errorf("expected 3 groups, got %d:\n%s", n, svg)
+	}
+	for _, z := range []string{"-1", "-2", "-3"} {
+		if !strings.Contains(svg, "data-z=\""+z+"\"") {
+			t.Errorf("expected a group at Z%s", z)
+		}
+	}
+	if !strings.HasPrefix(svg, "<svg ") || !strings.HasSuffix(svg, "</svg>\n") {
+		t.Errorf("malformed svg:\n%s", svg)
+	}
+}
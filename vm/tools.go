@@ -0,0 +1,149 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/gcode"
+
+import "math"
+import "strconv"
+import "strings"
+
+// Tool definition
+type Tool struct {
+	Diameter     float64
+	CornerRadius float64
+	Description  string
+}
+
+// Tool definitions by tool index
+type ToolTable map[int]Tool
+
+// Parses a "key=value", "key:value" or "key:" token
+func splitToolToken(t string) (key, value string, ok bool) {
+	if idx := strings.IndexAny(t, "=:"); idx > 0 {
+		return strings.ToUpper(t[:idx]), t[idx+1:], true
+	}
+	return "", "", false
+}
+
+// Parses a tool definition comment, such as those emitted by Fusion 360 and Mach3 posts:
+//
+//	T1 D=6. CR=0. - ZMIN=-5. - flat end mill
+//	Tool: 1 Dia: 6.35 End Mill
+func parseToolComment(c string) (int, Tool, bool) {
+	var (
+		tool  Tool
+		index int
+		err   error
+		desc  []string
+	)
+
+	fields := strings.Fields(c)
+	if len(fields) < 2 {
+		return 0, tool, false
+	}
+
+	f := strings.ToUpper(fields[0])
+	switch {
+	case f == "TOOL" || f == "TOOL:" || f == "TOOL#":
+		index, err = strconv.Atoi(strings.TrimPrefix(fields[1], "#"))
+		fields = fields[2:]
+	case len(f) > 1 && f[0] == 'T':
+		index, err = strconv.Atoi(strings.TrimSuffix(f[1:], ":"))
+		fields = fields[1:]
+	default:
+		return 0, tool, false
+	}
+	if err != nil {
+		return 0, tool, false
+	}
+
+	for idx := 0; idx < len(fields); idx++ {
+		key, value, ok := splitToolToken(fields[idx])
+		if !ok {
+			if fields[idx] != "-" {
+				desc = append(desc, fields[idx])
+			}
+			continue
+		}
+		if value == "" && idx+1 < len(fields) {
+			idx++
+			value = fields[idx]
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		switch key {
+		case "D", "DIA", "DIAMETER":
+			tool.Diameter = v
+		case "CR", "R":
+			tool.CornerRadius = v
+		}
+	}
+
+	if tool.Diameter == 0 && len(desc) == 0 {
+		return 0, tool, false
+	}
+	tool.Description = strings.Join(desc, " ")
+	return index, tool, true
+}
+
+// Extracts tool definitions from comments
+func ParseToolComments(doc *gcode.Document) ToolTable {
+	res := make(ToolTable)
+	for _, b := range doc.Blocks {
+		for _, n := range b.Nodes {
+			if c, ok := n.(*gcode.Comment); ok {
+				if index, tool, ok := parseToolComment(c.Content); ok {
+					res[index] = tool
+				}
+			}
+		}
+	}
+	return res
+}
+
+// Route all tool changes through ToolChangePos.
+// Before every tool change, the tool is retracted to safety height, moved to ToolChangePos and
+// lowered to its Z. After the change, it returns the same way to where it left the work.
+func (vm *Machine) EnforceToolChangeRetract() {
+	vm.Record("EnforceToolChangeRetract", vm.ToolChangePos)
+	var (
+		safetyHeight float64    = vm.FindSafetyHeight()
+		tc           [3]float64 = vm.ToolChangePos
+		npos         []Position = make([]Position, 0, len(vm.Positions))
+		remap        []int      = make([]int, len(vm.Positions))
+	)
+
+	for idx, pos := range vm.Positions {
+		if idx > 0 && pos.State.ToolIndex != vm.Positions[idx-1].State.ToolIndex {
+			prev := vm.Positions[idx-1]
+			height := math.Max(safetyHeight, tc[2])
+
+			p := prev
+			p.State.MoveMode = MoveModeRapid
+			p.Z = height
+			npos = append(npos, p)
+			p.X, p.Y = tc[0], tc[1]
+			npos = append(npos, p)
+			p.Z = tc[2]
+			npos = append(npos, p)
+
+			// The tool change happens with the state of the next move
+			q := p
+			q.State = pos.State
+			q.State.MoveMode = MoveModeRapid
+			npos = append(npos, q)
+			q.Z = height
+			npos = append(npos, q)
+			q.X, q.Y = prev.X, prev.Y
+			npos = append(npos, q)
+			q.Z = prev.Z
+			npos = append(npos, q)
+		}
+		remap[idx] = len(npos)
+		npos = append(npos, pos)
+	}
+
+	vm.Positions = npos
+	vm.RemapDiagnostics(remap)
+}
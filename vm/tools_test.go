@@ -0,0 +1,82 @@
+package vm
+
+import "math"
+import "testing"
+import "github.com/kennylevinsen/gocnc/gcode"
+
+func TestParseToolComments(t *testing.T) {
+	doc, err := gcode.Parse("(T1 D=6.0 CR=0.5 - ZMIN=-5.0 - flat end mill)\n(Tool: 2 Dia: 3.175 Ball Mill)\n(Not a tool)\nG21G90\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := ParseToolComments(doc)
+	expected := ToolTable{
+		1: Tool{Diameter: 6, CornerRadius: 0.5, Description: "flat end mill"},
+		2: Tool{Diameter: 3.175, Description: "Ball Mill"},
+	}
+	if len(tools) != len(expected) {
+		t.Errorf("expected %d tools, got %v", len(expected), tools)
+	}
+	for idx, tool := range expected {
+		if tools[idx] != tool {
+			t.Errorf("tool %d: expected %+v, got %+v", idx, tool, tools[idx])
+		}
+	}
+}
+
+func TestEnforceToolChangeRetract(t *testing.T) {
+	m := process(t, "G21G90\nT1M6\nG0X10Y10Z5\nG1F100Z-1\nX20\nT2M6\nX30\n")
+	m.ToolChangePos = [3]float64{-50, 0, 20}
+	m.EnforceToolChangeRetract()
+
+	at := -1
+	for idx, pos := range m.Positions {
+		if pos.X == -50 && pos.Y == 0 && pos.Z == 20 && pos.State.ToolIndex == 2 {
+			at = idx
+			break
+		}
+	}
+	if at < 1 {
+		t.Fatal("expected the tool change at the tool change position")
+	}
+	if before := m.Positions[at-1]; before.State.ToolIndex != 1 || before.Vector() != m.Positions[at].Vector() {
+		t.Errorf("expected the old tool to arrive at the tool change position, got %v", before.Vector())
+	}
+
+	// Back to where the work was left before continuing
+	next := at + 1
+	for m.Positions[next].X != 20 || m.Positions[next].Z != -1 {
+		if m.Positions[next].State.MoveMode != MoveModeRapid {
+			t.Fatalf("expected rapids back to the work, got mode %d at %d", m.Positions[next].State.MoveMode, next)
+		}
+		next++
+	}
+	if p := m.Positions[next+1]; p.X != 30 || p.State.ToolIndex != 2 {
+		t.Errorf("expected the cut to X30 to follow, got %v", p.Vector())
+	}
+}
+
+func TestEnforceToolChangeRetractDiagnostics(t *testing.T) {
+	m := process(t, "G21G90\nT1M6\nG0X10Y10Z5\nG1F100Z-1\nX20\nT2M6\nG2X30Y10I5J0\nT2M6\nG1X40\n")
+	m.ToolChangePos = [3]float64{-50, 0, 20}
+	m.EnforceToolChangeRetract()
+
+	if len(m.Arcs) != 1 {
+		t.Fatalf("expected the arc to be kept, got %d arcs", len(m.Arcs))
+	}
+	a := m.Arcs[0]
+	if p := m.Positions[a.Index]; math.Hypot(p.X-20, p.Y-10) > 1e-9 || p.Z != -1 {
+		t.Errorf("expected the arc to start at X20Y10, got %v", p.Vector())
+	}
+	if p := m.Positions[a.End]; p.X != 30 || p.Y != 10 {
+		t.Errorf("expected the arc to end at X30Y10, got %v", p.Vector())
+	}
+
+	c := m.CheckRedundantToolChange()
+	if len(c) != 1 {
+		t.Fatalf("expected 1 redundant tool change, got %v", c)
+	}
+	if p := m.Positions[c[0]]; p.X != 40 {
+		t.Errorf("expected the change before the cut to X40, got %v", p.Vector())
+	}
+}
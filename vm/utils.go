@@ -3,18 +3,211 @@ package vm
 import "errors"
 import "fmt"
 import "math"
+import "sort"
+import "strings"
 import "time"
+import "github.com/kennylevinsen/gocnc/vector"
+
+// Records a transform applied to the machine, with its parameters, for History
+func (vm *Machine) Record(name string, params ...interface{}) {
+	s := make([]string, len(params))
+	for idx, p := range params {
+		s[idx] = fmt.Sprintf("%v", p)
+	}
+	vm.history = append(vm.history, fmt.Sprintf("%s(%s)", name, strings.Join(s, ", ")))
+}
+
+// Lists the transforms applied to the machine, in order
+func (vm *Machine) History() []string {
+	return append([]string(nil), vm.history...)
+}
+
+// Tolerance used for coordinate comparisons
+const epsilon = 1e-9
+
+// Tests if a height is in the stock, that is, at or below the stock top.
+// All comparisons against StockTop go through this, so that moves at the stock top are treated
+// alike everywhere.
+func (vm *Machine) InStock(z float64) bool {
+	return z <= vm.StockTop
+}
+
+// Tests if the position is a feed move ending in the stock
+func (vm *Machine) cutting(pos Position) bool {
+	return pos.State.MoveMode == MoveModeLinear && vm.InStock(pos.Z)
+}
 
 // Flips the X and Y axes of all moves
 func (vm *Machine) FlipXY() {
+	vm.Record("FlipXY")
 	for idx := range vm.Positions {
 		pos := vm.Positions[idx]
 		vm.Positions[idx].X, vm.Positions[idx].Y = pos.Y, pos.X
 	}
 }
 
+// Inverts the Z axis of all moves, for converting programs using positive-down Z.
+// The stock top is inverted along with the moves, and arcs in planes involving Z change
+// direction, as mirroring a plane reverses its rotation.
+func (vm *Machine) InvertZ() {
+	vm.Record("InvertZ")
+	for idx := range vm.Positions {
+		vm.Positions[idx].Z = -vm.Positions[idx].Z
+	}
+	for idx, arc := range vm.Arcs {
+		if arc.Plane != PlaneXY {
+			vm.Arcs[idx].Clockwise = !arc.Clockwise
+		}
+	}
+	vm.StoredPos1.Z = -vm.StoredPos1.Z
+	vm.StoredPos2.Z = -vm.StoredPos2.Z
+	vm.StockTop = -vm.StockTop
+}
+
+// Mirrors all moves about the Y axis, negating X.
+// Mirroring reverses the direction of arcs in planes involving X. If flipSpindle is set, the
+// spindle direction is reversed as well, keeping the climb or conventional milling of the
+// original program.
+func (vm *Machine) MirrorX(flipSpindle bool) {
+	vm.Record("MirrorX", flipSpindle)
+	vm.mirror(0, flipSpindle)
+}
+
+// Mirrors all moves about the X axis, negating Y.
+// Mirroring reverses the direction of arcs in planes involving Y. If flipSpindle is set, the
+// spindle direction is reversed as well, keeping the climb or conventional milling of the
+// original program.
+func (vm *Machine) MirrorY(flipSpindle bool) {
+	vm.Record("MirrorY", flipSpindle)
+	vm.mirror(1, flipSpindle)
+}
+
+// Negates the given axis (X=0, Y=1) of all moves
+func (vm *Machine) mirror(axis int, flipSpindle bool) {
+	negate := func(x, y *float64) {
+		if axis == 0 {
+			*x = -*x
+		} else {
+			*y = -*y
+		}
+	}
+	for idx := range vm.Positions {
+		pos := &vm.Positions[idx]
+		negate(&pos.X, &pos.Y)
+		if flipSpindle {
+			pos.State.SpindleClockwise = !pos.State.SpindleClockwise
+		}
+	}
+	negate(&vm.StoredPos1.X, &vm.StoredPos1.Y)
+	negate(&vm.StoredPos2.X, &vm.StoredPos2.Y)
+	for idx, arc := range vm.Arcs {
+		if axes, err := planeAxes(arc.Plane); err == nil && axes[2] != axis {
+			vm.Arcs[idx].Clockwise = !arc.Clockwise
+		}
+	}
+}
+
+// Shears all moves in the XY plane, such that x' = x + shxy*y and y' = y + shyx*x.
+// Arcs are already linearized, so they are correctly turned into ellipses.
+func (vm *Machine) Shear(shxy, shyx float64) {
+	vm.Record("Shear", shxy, shyx)
+	shear := func(x, y float64) (float64, float64) {
+		return x + shxy*y, y + shyx*x
+	}
+	for idx, pos := range vm.Positions {
+		vm.Positions[idx].X, vm.Positions[idx].Y = shear(pos.X, pos.Y)
+	}
+	vm.StoredPos1.X, vm.StoredPos1.Y = shear(vm.StoredPos1.X, vm.StoredPos1.Y)
+	vm.StoredPos2.X, vm.StoredPos2.Y = shear(vm.StoredPos2.X, vm.StoredPos2.Y)
+}
+
+// Rotates all moves counterclockwise in the XY plane by angle (degrees) around px, py.
+// Arcs are already linearized, so their points are rotated along with the rest, and as rotation
+// preserves handedness, their recorded direction is unchanged.
+func (vm *Machine) RotateXY(angle, px, py float64) {
+	vm.Record("RotateXY", angle, px, py)
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	rotate := func(x, y float64) (float64, float64) {
+		dx, dy := x-px, y-py
+		return px + dx*cos - dy*sin, py + dx*sin + dy*cos
+	}
+	for idx, pos := range vm.Positions {
+		vm.Positions[idx].X, vm.Positions[idx].Y = rotate(pos.X, pos.Y)
+	}
+	vm.StoredPos1.X, vm.StoredPos1.Y = rotate(vm.StoredPos1.X, vm.StoredPos1.Y)
+	vm.StoredPos2.X, vm.StoredPos2.Y = rotate(vm.StoredPos2.X, vm.StoredPos2.Y)
+}
+
+// Returns the axis indexes (X=0, Y=1, Z=2) of the first and second arc axis and normal of a plane
+func planeAxes(plane int) ([3]int, error) {
+	switch plane {
+	case PlaneXY:
+		return [3]int{0, 1, 2}, nil
+	case PlaneXZ:
+		return [3]int{2, 0, 1}, nil
+	case PlaneYZ:
+		return [3]int{1, 2, 0}, nil
+	}
+	return [3]int{}, errors.New(fmt.Sprintf("Unknown plane %d", plane))
+}
+
+// Reprojects the program so that arcs in the from plane are in the to plane.
+// The axes only in one of the planes are swapped, keeping the axis the planes share. As this
+// mirrors the program, arcs change direction. Programs with arcs in other planes, or with helical
+// arcs, which would move along the normal of the new plane, cannot be reprojected.
+func (vm *Machine) ReprojectArcs(from, to int) error {
+	src, err := planeAxes(from)
+	if err != nil {
+		return err
+	}
+	dst, err := planeAxes(to)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+
+	for _, arc := range vm.Arcs {
+		if arc.Plane != from {
+			return errors.New(fmt.Sprintf("Arc at position %d is not in plane %d", arc.Index, from))
+		}
+		a := vm.Positions[arc.Index]
+		av := [3]float64{a.X, a.Y, a.Z}
+		for idx := arc.Index + 1; idx <= arc.End && idx < len(vm.Positions); idx++ {
+			b := vm.Positions[idx]
+			bv := [3]float64{b.X, b.Y, b.Z}
+			if math.Abs(bv[src[2]]-av[src[2]]) > epsilon {
+				return errors.New(fmt.Sprintf("Helical arc at position %d cannot be reprojected", arc.Index))
+			}
+		}
+	}
+
+	swap := func(x, y, z float64) (float64, float64, float64) {
+		v := [3]float64{x, y, z}
+		v[src[2]], v[dst[2]] = v[dst[2]], v[src[2]]
+		return v[0], v[1], v[2]
+	}
+
+	for idx, pos := range vm.Positions {
+		vm.Positions[idx].X, vm.Positions[idx].Y, vm.Positions[idx].Z = swap(pos.X, pos.Y, pos.Z)
+	}
+	vm.StoredPos1.X, vm.StoredPos1.Y, vm.StoredPos1.Z = swap(vm.StoredPos1.X, vm.StoredPos1.Y, vm.StoredPos1.Z)
+	vm.StoredPos2.X, vm.StoredPos2.Y, vm.StoredPos2.Z = swap(vm.StoredPos2.X, vm.StoredPos2.Y, vm.StoredPos2.Z)
+	for idx := range vm.Arcs {
+		vm.Arcs[idx].Plane = to
+		vm.Arcs[idx].Clockwise = !vm.Arcs[idx].Clockwise
+	}
+	if vm.MovePlane == from {
+		vm.MovePlane = to
+	}
+	vm.Record("ReprojectArcs", from, to)
+	return nil
+}
+
 // Limit feedrate.
 func (vm *Machine) LimitFeedrate(feed float64) {
+	vm.Record("LimitFeedrate", feed)
 	for idx, m := range vm.Positions {
 		if m.State.Feedrate > feed {
 			vm.Positions[idx].State.Feedrate = feed
@@ -22,15 +215,298 @@ func (vm *Machine) LimitFeedrate(feed float64) {
 	}
 }
 
+// Clamp feedrate.
+// Feedrates of linear moves below min are raised, and all feedrates above max are capped.
+// A bound <= 0 is ignored.
+func (vm *Machine) ClampFeedrate(min, max float64) {
+	vm.Record("ClampFeedrate", min, max)
+	for idx, m := range vm.Positions {
+		if min > 0 && m.State.MoveMode == MoveModeLinear && m.State.FeedMode != FeedModeInvTime && m.State.Feedrate < min {
+			vm.Positions[idx].State.Feedrate = min
+		}
+		if max > 0 && m.State.Feedrate > max {
+			vm.Positions[idx].State.Feedrate = max
+		}
+	}
+}
+
+// Turn all retracts (Z-only upwards moves) into feed moves at the given feedrate, in mm/min.
+func (vm *Machine) SetRetractFeed(feed float64) {
+	vm.Record("SetRetractFeed", feed)
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		last, m := vm.Positions[idx-1], vm.Positions[idx]
+		if m.State.MoveMode != MoveModeRapid && m.State.MoveMode != MoveModeLinear {
+			continue
+		}
+		if m.X == last.X && m.Y == last.Y && m.Z > last.Z {
+			vm.Positions[idx].State.MoveMode = MoveModeLinear
+			vm.Positions[idx].State.FeedMode = FeedModeUnitsMin
+			vm.Positions[idx].State.Feedrate = feed
+		}
+	}
+}
+
+// Adapt feedrates to the estimated tool engagement, as by EngagementEstimate.
+// Lateral cuts engaging more than maxEngagement (radians) are slowed to
+// baseFeed*maxEngagement/engagement, and all other lateral cuts run at baseFeed. The tool radius
+// is taken from Tools, and the stepover from DetectStepover, falling back to the tool radius.
+// Moves made with tools without a diameter, plunges and inverse time moves are left alone.
+func (vm *Machine) AdaptiveFeed(baseFeed, maxEngagement float64) {
+	vm.Record("AdaptiveFeed", baseFeed, maxEngagement)
+	estimates := make(map[int][]float64)
+	for idx, pos := range vm.Positions {
+		if pos.State.FeedMode == FeedModeInvTime {
+			continue
+		}
+
+		tool := pos.State.ToolIndex
+		est, ok := estimates[tool]
+		if !ok {
+			if t := vm.Tools[tool]; t.Diameter > 0 {
+				radius := t.Diameter / 2
+				stepover, _ := vm.DetectStepover(radius)
+				if stepover <= 0 {
+					stepover = radius
+				}
+				est = vm.EngagementEstimate(radius, stepover)
+			}
+			estimates[tool] = est
+		}
+		if est == nil || est[idx] == 0 {
+			continue
+		}
+
+		feed := baseFeed
+		if est[idx] > maxEngagement {
+			feed *= maxEngagement / est[idx]
+		}
+		vm.Positions[idx].State.Feedrate = feed
+	}
+}
+
+// Limit feedrate by centripetal acceleration.
+// At every vertex between two linear moves, the local radius of the path is taken as the radius of
+// the circle through the vertex and its neighbours, and the feedrate of both moves is reduced so
+// that v^2/r does not exceed maxAccel, in mm/s^2. Inverse time feedrates are left alone.
+func (vm *Machine) LimitArcFeed(maxAccel float64) {
+	vm.Record("LimitArcFeed", maxAccel)
+	if maxAccel <= 0 {
+		return
+	}
+	mp := vm.Positions
+	for idx := 1; idx < len(mp)-1; idx++ {
+		a, b, c := mp[idx-1].Vector(), mp[idx].Vector(), mp[idx+1].Vector()
+		if mp[idx].State.MoveMode != MoveModeLinear || mp[idx+1].State.MoveMode != MoveModeLinear {
+			continue
+		}
+
+		// Circumradius: |ab| |bc| |ca| / (2 |ab x bc|)
+		ab, bc, ca := b.Diff(a), c.Diff(b), a.Diff(c)
+		area := ab.Cross(bc).Norm()
+		if area < epsilon {
+			continue
+		}
+		r := ab.Norm() * bc.Norm() * ca.Norm() / (2 * area)
+		feed := math.Sqrt(maxAccel*r) * 60
+
+		for _, i := range []int{idx, idx + 1} {
+			if mp[i].State.FeedMode != FeedModeInvTime && mp[i].State.Feedrate > feed {
+				mp[i].State.Feedrate = feed
+			}
+		}
+	}
+}
+
+// Smooth feedrates by linear acceleration.
+// Between consecutive cutting moves, feedrates are reduced so that the change in speed over the
+// length of a move never needs more than accel, in mm/s^2, such that v1^2 <= v0^2 + 2*accel*l.
+// Speed is gained over the faster move and lost over the slower one, so feed increases are spread
+// over the following moves, and decreases over the preceding ones.
+// Inverse time feedrates are left alone.
+func (vm *Machine) SmoothFeedByAccel(accel float64) {
+	vm.Record("SmoothFeedByAccel", accel)
+	if accel <= 0 {
+		return
+	}
+	mp := vm.Positions
+	linked := func(idx int) bool {
+		return idx > 0 && vm.cutting(mp[idx-1]) && vm.cutting(mp[idx]) &&
+			mp[idx-1].State.FeedMode != FeedModeInvTime && mp[idx].State.FeedMode != FeedModeInvTime
+	}
+	limit := func(idx int, from, dist float64) {
+		v := from / 60
+		if feed := math.Sqrt(v*v+2*accel*dist) * 60; mp[idx].State.Feedrate > feed {
+			mp[idx].State.Feedrate = feed
+		}
+	}
+
+	length := func(idx int) float64 {
+		if idx == 0 {
+			return 0
+		}
+		return mp[idx].Vector().Diff(mp[idx-1].Vector()).Norm()
+	}
+
+	// Accelerate over each move, and decelerate over the move before it
+	for idx := 1; idx < len(mp); idx++ {
+		if linked(idx) {
+			limit(idx, mp[idx-1].State.Feedrate, length(idx))
+		}
+	}
+	for idx := len(mp) - 1; idx > 0; idx-- {
+		if linked(idx) {
+			limit(idx-1, mp[idx].State.Feedrate, length(idx-1))
+		}
+	}
+}
+
+// Set feedrates of arc segments for a constant chip load, in mm per spindle revolution.
+// At a radial engagement below half the tool diameter, the chip is thinner than the feed per
+// revolution, so the feed is raised by 1/sin of the engagement angle to compensate. Engagement is
+// estimated by EngagementEstimate, using the stepover from DetectStepover, or toolRadius if none is
+// found. Only the segments of recorded arcs are changed. Inverse time moves and units per minute
+// moves without a spindle speed are left alone.
+func (vm *Machine) ChipThinningFeed(toolRadius, targetChipLoad float64) {
+	vm.Record("ChipThinningFeed", toolRadius, targetChipLoad)
+	stepover, _ := vm.DetectStepover(toolRadius)
+	if stepover <= 0 {
+		stepover = toolRadius
+	}
+	engagement := vm.EngagementEstimate(toolRadius, stepover)
+
+	for _, arc := range vm.Arcs {
+		// The linearized arc starts with its start point, unless it collapsed to its end point
+		first := arc.Index + 1
+		if arc.End == arc.Index {
+			first = arc.Index
+		}
+		for idx := first; idx <= arc.End && idx < len(vm.Positions); idx++ {
+			pos := &vm.Positions[idx]
+			if !vm.cutting(*pos) || engagement[idx] == 0 {
+				continue
+			}
+			factor := 1 / math.Sin(math.Min(engagement[idx], math.Pi/2))
+			switch pos.State.FeedMode {
+			case FeedModeInvTime:
+			case FeedModeUnitsRev:
+				pos.State.Feedrate = targetChipLoad * factor
+			default:
+				if pos.State.SpindleSpeed > 0 {
+					pos.State.Feedrate = targetChipLoad * pos.State.SpindleSpeed * factor
+				}
+			}
+		}
+	}
+}
+
+// Convert all feedrates to units per minute.
+// Inverse time feedrates are converted using the move length, and units per revolution
+// feedrates using the spindle speed.
+func (vm *Machine) NormalizeFeedUnits() {
+	vm.Record("NormalizeFeedUnits")
+	for idx := range vm.Positions {
+		pos := &vm.Positions[idx]
+		switch pos.State.FeedMode {
+		case FeedModeInvTime:
+			if idx > 0 && pos.State.Feedrate > 0 {
+				pos.State.Feedrate *= pos.Vector().Diff(vm.Positions[idx-1].Vector()).Norm()
+			}
+		case FeedModeUnitsRev:
+			pos.State.Feedrate *= pos.State.SpindleSpeed
+		}
+		pos.State.FeedMode = FeedModeUnitsMin
+	}
+}
+
+// Feedrate for cutting moves down to a depth below the stock top
+type DepthFeed struct {
+	MaxDepth, Feed float64
+}
+
+// Set the feedrate of cutting moves by depth.
+// Every cutting move gets the feedrate of the band with the smallest MaxDepth that its depth does
+// not exceed. Moves deeper than all bands are left alone.
+func (vm *Machine) FeedByDepth(table []DepthFeed) {
+	vm.Record("FeedByDepth", table)
+	for idx, pos := range vm.Positions {
+		if !vm.cutting(pos) {
+			continue
+		}
+		depth := vm.StockTop - pos.Z
+		band := -1
+		for b, df := range table {
+			if depth <= df.MaxDepth+epsilon && (band == -1 || df.MaxDepth < table[band].MaxDepth) {
+				band = b
+			}
+		}
+		if band != -1 {
+			vm.Positions[idx].State.Feedrate = table[band].Feed
+		}
+	}
+}
+
 // Increase feedrate
 func (vm *Machine) FeedrateMultiplier(feedMultiplier float64) {
+	vm.Record("FeedrateMultiplier", feedMultiplier)
 	for idx := range vm.Positions {
 		vm.Positions[idx].State.Feedrate *= feedMultiplier
 	}
 }
 
+// Scale the feedrate of all linear moves to approach a target runtime, as estimated by ETA.
+// Scaled feedrates are capped at maxFeed if > 0. The multiplier is found by bisection, applied,
+// and returned. An error is returned if the target cannot be reached.
+func (vm *Machine) ScaleToTargetTime(target time.Duration, maxFeed float64) (float64, error) {
+	orig := vm.Positions
+	scaled := make([]Position, len(orig))
+	eta := func(multiplier float64) time.Duration {
+		copy(scaled, orig)
+		for idx := range scaled {
+			if scaled[idx].State.MoveMode != MoveModeLinear {
+				continue
+			}
+			scaled[idx].State.Feedrate *= multiplier
+			if maxFeed > 0 && scaled[idx].State.Feedrate > maxFeed {
+				scaled[idx].State.Feedrate = maxFeed
+			}
+		}
+		vm.Positions = scaled
+		defer func() { vm.Positions = orig }()
+		return vm.ETA()
+	}
+
+	lo, hi := 1.0, 1.0
+	for eta(hi) > target {
+		if hi > 1e9 {
+			return 0, errors.New(fmt.Sprintf("Target time of %s cannot be reached", target))
+		}
+		hi *= 2
+	}
+	for eta(lo) < target {
+		if lo < 1e-9 {
+			return 0, errors.New(fmt.Sprintf("Target time of %s cannot be reached", target))
+		}
+		lo /= 2
+	}
+
+	for i := 0; i < 100 && hi-lo > 1e-9*hi; i++ {
+		mid := (lo + hi) / 2
+		if eta(mid) > target {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	eta(hi)
+	vm.Positions = scaled
+	vm.Record("ScaleToTargetTime", target, maxFeed)
+	return hi, nil
+}
+
 // Multiply move distances - This makes no sense - Dangerous.
 func (vm *Machine) MoveMultiplier(moveMultiplier float64) {
+	vm.Record("MoveMultiplier", moveMultiplier)
 	for idx := range vm.Positions {
 		vm.Positions[idx].X *= moveMultiplier
 		vm.Positions[idx].Y *= moveMultiplier
@@ -38,8 +514,24 @@ func (vm *Machine) MoveMultiplier(moveMultiplier float64) {
 	}
 }
 
+// Scale laser power with feedrate.
+// In laser mode, the power of every linear move is set to feedrate * feedToPowerRatio, capped at
+// the programmed power, so that slowing down for corners does not burn the material.
+func (vm *Machine) ScaleLaserPower(feedToPowerRatio float64) {
+	vm.Record("ScaleLaserPower", feedToPowerRatio)
+	if !vm.LaserMode {
+		return
+	}
+	for idx, m := range vm.Positions {
+		if m.State.MoveMode == MoveModeLinear && m.State.SpindleEnabled {
+			vm.Positions[idx].State.SpindleSpeed = math.Min(m.State.SpindleSpeed, m.State.Feedrate*feedToPowerRatio)
+		}
+	}
+}
+
 // Enforce spindle mode
 func (vm *Machine) EnforceSpindle(enabled, clockwise bool, speed float64) {
+	vm.Record("EnforceSpindle", enabled, clockwise, speed)
 	for idx := range vm.Positions {
 		vm.Positions[idx].State.SpindleSpeed = speed
 		vm.Positions[idx].State.SpindleEnabled = enabled
@@ -58,6 +550,67 @@ func (vm *Machine) FindSafetyHeight() float64 {
 	return maxz
 }
 
+// Calculates the lowest safe retract height, being clearance above the highest cutting move.
+// Feed moves above the stock top are not cutting, and do not raise the height.
+// Returns clearance if there are no cutting moves.
+func (vm *Machine) OptimalSafetyHeight(clearance float64) float64 {
+	var (
+		maxz  float64
+		found bool
+	)
+	for _, m := range vm.Positions {
+		if vm.cutting(m) && (!found || m.Z > maxz) {
+			maxz, found = m.Z, true
+		}
+	}
+	return maxz + clearance
+}
+
+// Strategies for safety height detection
+type SafetyStrategy int
+
+const (
+	SafetyMaxZ               SafetyStrategy = iota // Highest Z position
+	SafetyMostCommonRetractZ SafetyStrategy = iota // Most common Z-only lift height
+	SafetyFirstRapidZ        SafetyStrategy = iota // Z of the first rapid above the stock
+)
+
+// Detect the safety height using the given strategy
+func (vm *Machine) DetectSafetyHeight(strategy SafetyStrategy) (float64, error) {
+	switch strategy {
+	case SafetyMaxZ:
+		return vm.FindSafetyHeight(), nil
+	case SafetyMostCommonRetractZ:
+		counts := make(map[float64]int)
+		for idx := 1; idx < len(vm.Positions); idx++ {
+			last, m := vm.Positions[idx-1], vm.Positions[idx]
+			if m.X == last.X && m.Y == last.Y && m.Z > last.Z {
+				counts[m.Z]++
+			}
+		}
+		if len(counts) == 0 {
+			return 0, errors.New("No retracts found")
+		}
+		var best float64
+		bestCount := 0
+		for z, c := range counts {
+			if c > bestCount || (c == bestCount && z > best) {
+				best, bestCount = z, c
+			}
+		}
+		return best, nil
+	case SafetyFirstRapidZ:
+		for _, m := range vm.Positions {
+			if m.State.MoveMode == MoveModeRapid && !vm.InStock(m.Z) {
+				return m.Z, nil
+			}
+		}
+		return 0, errors.New("No rapid moves above stock found")
+	default:
+		return 0, errors.New(fmt.Sprintf("Unknown safety height strategy %d", strategy))
+	}
+}
+
 // Set safety-height.
 // Scans for the highest position on the Y axis, and afterwards replaces all instances
 // of this position with the requested height.
@@ -84,12 +637,15 @@ func (vm *Machine) SetSafetyHeight(height float64) error {
 		}
 		lastx, lasty = m.X, m.Y
 	}
+	vm.Record("SetSafetyHeight", height)
 	return nil
 }
 
 // Ensure return to X0 Y0 Z0.
 // Simply adds a what is necessary to move back to X0 Y0 Z0.
+// A program ending in the stock is always lifted to the highest Z position first.
 func (vm *Machine) Return(disableSpindle, disableCoolant bool) {
+	vm.Record("Return", disableSpindle, disableCoolant)
 	var maxz float64
 	for _, m := range vm.Positions {
 		if m.Z > maxz {
@@ -100,6 +656,11 @@ func (vm *Machine) Return(disableSpindle, disableCoolant bool) {
 		return
 	}
 	lastPos := vm.Positions[len(vm.Positions)-1]
+	if vm.InStock(lastPos.Z) {
+		lastPos.Z = maxz
+		lastPos.State.MoveMode = MoveModeRapid
+		vm.Positions = append(vm.Positions, lastPos)
+	}
 	if lastPos.X == 0 && lastPos.Y == 0 && lastPos.Z == 0 {
 		if disableSpindle {
 			lastPos.State.SpindleEnabled = false
@@ -162,27 +723,25 @@ func (vm *Machine) Return(disableSpindle, disableCoolant bool) {
 	}
 }
 
+// Calculates the extents of the given positions
+func extents(positions []Position) (minx, miny, minz, maxx, maxy, maxz float64) {
+	if len(positions) == 0 {
+		return
+	}
+	minx, miny, minz = positions[0].X, positions[0].Y, positions[0].Z
+	maxx, maxy, maxz = minx, miny, minz
+	for _, pos := range positions {
+		minx, maxx = math.Min(minx, pos.X), math.Max(maxx, pos.X)
+		miny, maxy = math.Min(miny, pos.Y), math.Max(maxy, pos.Y)
+		minz, maxz = math.Min(minz, pos.Z), math.Max(maxz, pos.Z)
+	}
+	return
+}
+
 // Generate move information
 func (vm *Machine) Info() (minx, miny, minz, maxx, maxy, maxz float64, feedrates []float64) {
+	minx, miny, minz, maxx, maxy, maxz = extents(vm.Positions)
 	for _, pos := range vm.Positions {
-		if pos.X < minx {
-			minx = pos.X
-		} else if pos.X > maxx {
-			maxx = pos.X
-		}
-
-		if pos.Y < miny {
-			miny = pos.Y
-		} else if pos.Y > maxy {
-			maxy = pos.Y
-		}
-
-		if pos.Z < minz {
-			minz = pos.Z
-		} else if pos.Z > maxz {
-			maxz = pos.Z
-		}
-
 		feedrateFound := false
 		for _, feed := range feedrates {
 			if feed == pos.State.Feedrate {
@@ -197,18 +756,27 @@ func (vm *Machine) Info() (minx, miny, minz, maxx, maxy, maxz float64, feedrates
 	return
 }
 
+// Time assumed for spindle orientation
+const orientTime = 2 * time.Second
+
 // Estimate runtime for job
-func (m *Machine) ETA() time.Duration {
+func (vm *Machine) ETA() time.Duration {
+	cutting, rapid, dwell, toolChange := vm.ETABreakdown()
+	return cutting + rapid + dwell + toolChange
+}
+
+// Estimate runtime for job, split into time spent on feed moves, rapid moves, dwells and
+// tool changes.
+func (vm *Machine) ETABreakdown() (cutting, rapid, dwell, toolChange time.Duration) {
 	lastTool := -1
 	lastToolSuggestion := -1
-	var eta time.Duration
 	var lx, ly, lz float64
-	for _, pos := range m.Positions {
+	for _, pos := range vm.Positions {
 		if pos.State.ToolIndex != lastTool {
 			if pos.State.ToolIndex == lastToolSuggestion {
-				eta += 5 * time.Second
+				toolChange += 5 * time.Second
 			} else {
-				eta += 10 * time.Second
+				toolChange += 10 * time.Second
 			}
 		}
 		lastTool = pos.State.ToolIndex
@@ -223,21 +791,557 @@ func (m *Machine) ETA() time.Duration {
 		// Convert from minutes to microseconds
 		feed /= 60000000
 
+		dx, dy, dz := pos.X-lx, pos.Y-ly, pos.Z-lz
+		lx, ly, lz = pos.X, pos.Y, pos.Z
+		dist := math.Sqrt(math.Pow(dx, 2) + math.Pow(dy, 2) + math.Pow(dz, 2))
+
 		switch pos.State.MoveMode {
-		case MoveModeNone:
-			continue
 		case MoveModeRapid:
 			// This is silly, but it gives something to calculate with
 			feed *= 8
+			rapid += time.Duration(dist/feed) * time.Microsecond
 		case MoveModeDwell:
-			eta += time.Duration(pos.State.DwellTime) * time.Second
+			dwell += time.Duration(pos.State.DwellTime * float64(time.Second))
+		case MoveModeOrient:
+			dwell += orientTime
+		case MoveModeProbe:
+			// Probing runs at feedrate, and may stop anywhere before the target
+			cutting += time.Duration(dist/feed) * time.Microsecond
+		case MoveModeNone:
+		default:
+			cutting += time.Duration(dist/feed) * time.Microsecond
+		}
+	}
+	return
+}
+
+// Retrieves the state at a position index
+func (vm *Machine) StateAt(index int) (State, error) {
+	if index < 0 || index >= len(vm.Positions) {
+		return State{}, errors.New(fmt.Sprintf("Position index %d out of range [0, %d)", index, len(vm.Positions)))
+	}
+	return vm.Positions[index].State, nil
+}
+
+// Retrieves the active tool at a position index, or -1 if none or out of range
+func (vm *Machine) ActiveTool(index int) int {
+	s, err := vm.StateAt(index)
+	if err != nil {
+		return -1
+	}
+	return s.ToolIndex
+}
+
+// Copy the machine, keeping only cutting moves.
+// Separate cuts are joined by null moves, so that they do not connect.
+func (vm *Machine) CuttingOnly() *Machine {
+	n := *vm
+	n.Positions = nil
+	n.Arcs = nil
+	n.redundantToolChanges = nil
+	n.ArcDeviations = append([]ArcDeviation(nil), vm.ArcDeviations...)
+	n.redundantModals = append([]int(nil), vm.redundantModals...)
+	n.history = append([]string(nil), vm.history...)
+	n.CoordinateSystem.coordinateSystems = append([]vector.Vector(nil), vm.CoordinateSystem.coordinateSystems...)
+	if vm.Tools != nil {
+		n.Tools = make(ToolTable)
+		for k, v := range vm.Tools {
+			n.Tools[k] = v
+		}
+	}
+	if vm.assertedModals != nil {
+		n.assertedModals = make(map[string]bool)
+		for k, v := range vm.assertedModals {
+			n.assertedModals[k] = v
+		}
+	}
+	n.Record("CuttingOnly")
+
+	last := -1
+	for idx, pos := range vm.Positions {
+		if idx == 0 || !vm.cutting(pos) {
 			continue
 		}
-		dx, dy, dz := pos.X-lx, pos.Y-ly, pos.Z-lz
-		lx, ly, lz = pos.X, pos.Y, pos.Z
+		if last != idx-1 {
+			gap := vm.Positions[idx-1]
+			gap.State.MoveMode = MoveModeNone
+			n.Positions = append(n.Positions, gap)
+		}
+		n.Positions = append(n.Positions, pos)
+		last = idx
+	}
+	return &n
+}
 
-		dist := math.Sqrt(math.Pow(dx, 2) + math.Pow(dy, 2) + math.Pow(dz, 2))
-		eta += time.Duration(dist/feed) * time.Microsecond
+// Add backlash compensation.
+// Whenever an axis reverses direction, a move of the backlash distance along that axis is
+// inserted to take up the slack, and all following positions are offset accordingly.
+// A backlash <= 0 disables compensation for that axis.
+func (vm *Machine) AddBacklashComp(bx, by, bz float64) {
+	vm.Record("AddBacklashComp", bx, by, bz)
+	var (
+		npos      []Position = make([]Position, 0, len(vm.Positions))
+		remap     []int      = make([]int, len(vm.Positions))
+		backlash  [3]float64 = [3]float64{bx, by, bz}
+		direction [3]float64
+		offset    [3]float64
+	)
+
+	for idx, pos := range vm.Positions {
+		if idx > 0 {
+			prev := vm.Positions[idx-1]
+			delta := [3]float64{pos.X - prev.X, pos.Y - prev.Y, pos.Z - prev.Z}
+			comp := npos[len(npos)-1]
+			compensate := false
+
+			for axis := range delta {
+				if backlash[axis] <= 0 || delta[axis] == 0 {
+					continue
+				}
+				dir := math.Copysign(1, delta[axis])
+				if direction[axis] != 0 && dir != direction[axis] {
+					offset[axis] += dir * backlash[axis]
+					switch axis {
+					case 0:
+						comp.X += dir * backlash[axis]
+					case 1:
+						comp.Y += dir * backlash[axis]
+					case 2:
+						comp.Z += dir * backlash[axis]
+					}
+					compensate = true
+				}
+				direction[axis] = dir
+			}
+
+			if compensate {
+				comp.State = pos.State
+				npos = append(npos, comp)
+			}
+		}
+
+		pos.X += offset[0]
+		pos.Y += offset[1]
+		pos.Z += offset[2]
+		remap[idx] = len(npos)
+		npos = append(npos, pos)
+	}
+	vm.Positions = npos
+	vm.RemapDiagnostics(remap)
+}
+
+// Insert a dwell where the cutting direction reverses.
+// A dwell of the given seconds is inserted between consecutive cutting moves whose XY directions
+// differ by more than angleThreshold degrees, letting the tool recover before cutting back.
+func (vm *Machine) InsertDirectionDwell(angleThreshold, seconds float64) {
+	vm.Record("InsertDirectionDwell", angleThreshold, seconds)
+	var (
+		npos           []Position = make([]Position, 0, len(vm.Positions))
+		remap          []int      = make([]int, len(vm.Positions))
+		lastDx, lastDy float64
+		hasDirection   bool
+		threshold      float64 = angleThreshold * math.Pi / 180
+	)
+
+	for idx, pos := range vm.Positions {
+		if idx == 0 || !vm.cutting(pos) {
+			hasDirection = false
+		} else {
+			prev := vm.Positions[idx-1]
+			dx, dy := pos.X-prev.X, pos.Y-prev.Y
+			if math.Hypot(dx, dy) > epsilon {
+				if hasDirection {
+					angle := math.Abs(math.Atan2(lastDx*dy-lastDy*dx, lastDx*dx+lastDy*dy))
+					if angle > threshold {
+						dwell := npos[len(npos)-1]
+						dwell.State = pos.State
+						dwell.State.MoveMode = MoveModeDwell
+						dwell.State.DwellTime = seconds
+						npos = append(npos, dwell)
+					}
+				}
+				lastDx, lastDy, hasDirection = dx, dy, true
+			}
+		}
+		remap[idx] = len(npos)
+		npos = append(npos, pos)
+	}
+	vm.Positions = npos
+	vm.RemapDiagnostics(remap)
+}
+
+// Insert a dwell where the spindle reverses.
+// A dwell of the given seconds is inserted where the spindle direction changes while it stays
+// enabled, giving it time to stop and spin up in the new direction. Stopping the spindle does not
+// insert a dwell.
+func (vm *Machine) InsertSpindleReversalDwell(seconds float64) {
+	vm.Record("InsertSpindleReversalDwell", seconds)
+	var (
+		npos  []Position = make([]Position, 0, len(vm.Positions))
+		remap []int      = make([]int, len(vm.Positions))
+	)
+
+	for idx, pos := range vm.Positions {
+		if idx > 0 {
+			prev := vm.Positions[idx-1].State
+			if prev.SpindleEnabled && pos.State.SpindleEnabled && prev.SpindleClockwise != pos.State.SpindleClockwise {
+				dwell := npos[len(npos)-1]
+				dwell.State = pos.State
+				dwell.State.MoveMode = MoveModeDwell
+				dwell.State.DwellTime = seconds
+				npos = append(npos, dwell)
+			}
+		}
+		remap[idx] = len(npos)
+		npos = append(npos, pos)
+	}
+	vm.Positions = npos
+	vm.RemapDiagnostics(remap)
+}
+
+// Round corners of cutting contours.
+// Corners between consecutive cutting moves at the same Z are replaced by tangent fillets of the
+// given radius, linearized within MaxArcDeviation. The fillets stay inside the corners. Corners
+// where the fillet would need more than half of either move are left sharp.
+func (vm *Machine) RoundCorners(radius float64) error {
+	if radius <= 0 {
+		return errors.New(fmt.Sprintf("Invalid corner radius %g", radius))
+	}
+
+	var (
+		mp    []Position = vm.Positions
+		npos  []Position = make([]Position, 0, len(mp))
+		remap []int      = make([]int, len(mp))
+	)
+
+	for idx, b := range mp {
+		remap[idx] = len(npos)
+		if idx == 0 || idx == len(mp)-1 || !vm.cutting(b) || !vm.cutting(mp[idx+1]) {
+			npos = append(npos, b)
+			continue
+		}
+
+		a, c := mp[idx-1], mp[idx+1]
+		if math.Abs(a.Z-b.Z) > epsilon || math.Abs(c.Z-b.Z) > epsilon {
+			npos = append(npos, b)
+			continue
+		}
+
+		ax, ay := b.X-a.X, b.Y-a.Y
+		cx, cy := c.X-b.X, c.Y-b.Y
+		l1, l2 := math.Hypot(ax, ay), math.Hypot(cx, cy)
+		if l1 < epsilon || l2 < epsilon {
+			npos = append(npos, b)
+			continue
+		}
+		ax, ay, cx, cy = ax/l1, ay/l1, cx/l2, cy/l2
+
+		// Turn angle, positive for left turns
+		turn := math.Atan2(ax*cy-ay*cx, ax*cx+ay*cy)
+		t := radius * math.Tan(math.Abs(turn)/2)
+		if math.Abs(turn) < 1e-6 || math.Abs(turn) > math.Pi-1e-6 || t > l1/2 || t > l2/2 {
+			npos = append(npos, b)
+			continue
+		}
+
+		// Fillet center, to the inside of the turn from the start of the fillet
+		side := math.Copysign(1, turn)
+		sx, sy := b.X-ax*t, b.Y-ay*t
+		ox, oy := sx-ay*side*radius, sy+ax*side*radius
+
+		steps := 1
+		if vm.MaxArcDeviation < radius {
+			steps = int(math.Ceil(math.Abs(turn) / (2 * math.Acos(1-vm.MaxArcDeviation/radius))))
+		}
+
+		start := math.Atan2(sy-oy, sx-ox)
+		for i := 0; i <= steps; i++ {
+			angle := start + turn*float64(i)/float64(steps)
+			p := b
+			p.X, p.Y = ox+radius*math.Cos(angle), oy+radius*math.Sin(angle)
+			npos = append(npos, p)
+		}
+	}
+
+	vm.Positions = npos
+	vm.RemapDiagnostics(remap)
+	vm.Record("RoundCorners", radius)
+	return nil
+}
+
+// Add holding tabs to closed contours.
+// Along every closed contour (as by ContourEntryPoints), count tabs are evenly spaced by XY path
+// length, starting half a spacing from the entry point. Across the width of a tab, the tool is
+// raised to the given height. Contours too short to fit all tabs are left alone.
+func (vm *Machine) AddTabs(count int, height, width float64) error {
+	if count <= 0 || width <= 0 {
+		return errors.New(fmt.Sprintf("Invalid tab count %d or width %g", count, width))
+	}
+
+	var (
+		mp    []Position = vm.Positions
+		npos  []Position = make([]Position, 0, len(mp))
+		remap []int      = make([]int, len(mp))
+		ops   []Operation
+		tabs  [][2]float64
+		s     float64
+	)
+
+	for _, op := range vm.Operations() {
+		if vm.closedContour(op) {
+			ops = append(ops, op)
+		}
+	}
+
+	inside := func(s float64) bool {
+		for _, t := range tabs {
+			if s >= t[0] && s < t[1] {
+				return true
+			}
+		}
+		return false
+	}
+
+	add := func(p Position, raise bool) {
+		if raise && p.Z < height {
+			p.Z = height
+		}
+		if last := npos[len(npos)-1]; last.X == p.X && last.Y == p.Y && last.Z == p.Z {
+			return
+		}
+		npos = append(npos, p)
+	}
+
+	for idx, b := range mp {
+		for len(ops) > 0 && ops[0].End <= idx {
+			ops = ops[1:]
+		}
+		if len(ops) == 0 || idx < ops[0].Start {
+			remap[idx] = len(npos)
+			npos = append(npos, b)
+			continue
+		}
+
+		op := ops[0]
+		if idx == op.Start {
+			var length float64
+			for i := op.Start + 1; i < op.End; i++ {
+				length += math.Hypot(mp[i].X-mp[i-1].X, mp[i].Y-mp[i-1].Y)
+			}
+			tabs, s = nil, 0
+			if float64(count)*width < length {
+				for i := 0; i < count; i++ {
+					center := (float64(i) + 0.5) * length / float64(count)
+					tabs = append(tabs, [2]float64{center - width/2, center + width/2})
+				}
+			}
+			remap[idx] = len(npos)
+			npos = append(npos, b)
+			continue
+		}
+
+		a := mp[idx-1]
+		d := math.Hypot(b.X-a.X, b.Y-a.Y)
+		s0, s1 := s, s+d
+		s = s1
+
+		// Split the move at the tab edges it crosses
+		var edges []float64
+		for _, t := range tabs {
+			for _, e := range t {
+				if e > s0 && e <= s1 {
+					edges = append(edges, e)
+				}
+			}
+		}
+		sort.Float64s(edges)
+		for _, e := range edges {
+			f := (e - s0) / d
+			p := b
+			p.X, p.Y, p.Z = a.X+(b.X-a.X)*f, a.Y+(b.Y-a.Y)*f, a.Z+(b.Z-a.Z)*f
+			entering := inside(e)
+			add(p, !entering)
+			add(p, entering)
+		}
+		add(b, inside(s1))
+		remap[idx] = len(npos) - 1
+	}
+
+	vm.Positions = npos
+	vm.RemapDiagnostics(remap)
+	vm.Record("AddTabs", count, height, width)
+	return nil
+}
+
+// Trim pointless rapids before the first and after the last cut.
+// Leading rapids are replaced by a single approach from the last position before them: up to
+// safety height, across, and down to where the first cut starts. Trailing rapids are cut short once
+// they reach their highest point, keeping the final retract, unless other moves follow them.
+func (vm *Machine) TrimAirMoves() {
+	vm.Record("TrimAirMoves")
+	var (
+		mp          []Position = vm.Positions
+		first, last int        = -1, -1
+	)
+	for idx, pos := range mp {
+		if vm.cutting(pos) {
+			if first == -1 {
+				first = idx
+			}
+			last = idx
+		}
+	}
+	if first < 1 {
+		return
+	}
+
+	// Leading rapids, from mp[start] to the approach at mp[first-1]
+	approach := first - 1
+	start := approach
+	for start > 0 && mp[start].State.MoveMode == MoveModeRapid {
+		start--
+	}
+
+	// Trailing rapids, from mp[last] to mp[end], followed only by null moves
+	end := last
+	for end+1 < len(mp) && mp[end+1].State.MoveMode == MoveModeRapid {
+		end++
+	}
+	for idx := end + 1; idx < len(mp); idx++ {
+		if mp[idx].State.MoveMode != MoveModeNone {
+			end = last
+			break
+		}
+	}
+	retract := last
+	for idx := last + 1; idx <= end; idx++ {
+		if mp[idx].Z > mp[retract].Z {
+			retract = idx
+		}
+	}
+
+	var (
+		npos  []Position = make([]Position, 0, len(mp))
+		remap []int      = make([]int, len(mp))
+	)
+
+	add := func(p Position) {
+		if npos[len(npos)-1].Vector() != p.Vector() {
+			npos = append(npos, p)
+		}
+	}
+
+	for idx, pos := range mp {
+		switch {
+		case idx > start && idx < approach:
+			// Replaced by the approach
+			remap[idx] = len(npos)
+			continue
+		case idx == approach && start < approach-1:
+			safetyHeight := vm.FindSafetyHeight()
+			p := pos
+			p.X, p.Y, p.Z = mp[start].X, mp[start].Y, math.Max(mp[start].Z, safetyHeight)
+			add(p)
+			p.X, p.Y = pos.X, pos.Y
+			add(p)
+		case idx > retract && idx <= end:
+			remap[idx] = len(npos) - 1
+			continue
+		case idx > end && end > retract:
+			// Null moves stay with the retract
+			pos.X, pos.Y, pos.Z = mp[retract].X, mp[retract].Y, mp[retract].Z
+		}
+		remap[idx] = len(npos)
+		npos = append(npos, pos)
+	}
+
+	vm.Positions = npos
+	vm.RemapDiagnostics(remap)
+}
+
+// Remove leading positions that carry only state, such as the origin and setup blocks.
+// All state is carried by the following moves, so nothing is lost when appending.
+func (vm *Machine) StripPreamble() {
+	vm.Record("StripPreamble")
+	idx := 0
+	for idx < len(vm.Positions) {
+		pos := vm.Positions[idx]
+		if pos.State.MoveMode != MoveModeNone {
+			if idx == 0 || pos.Vector() != vm.Positions[idx-1].Vector() {
+				break
+			}
+			if pos.State.MoveMode != MoveModeRapid && pos.State.MoveMode != MoveModeLinear {
+				break
+			}
+		}
+		idx++
+	}
+
+	vm.Positions = vm.Positions[idx:]
+	arcs := vm.Arcs[:0]
+	for _, a := range vm.Arcs {
+		if a.Index >= idx {
+			a.Index -= idx
+			a.End -= idx
+			arcs = append(arcs, a)
+		}
+	}
+	vm.Arcs = arcs
+
+	changes := vm.redundantToolChanges[:0]
+	for _, c := range vm.redundantToolChanges {
+		if c >= idx {
+			changes = append(changes, c-idx)
+		}
+	}
+	vm.redundantToolChanges = changes
+}
+
+// Remove leading positions that do not move from the first position, keeping it as the start point.
+// All state is carried by the following moves, so nothing is lost.
+func (vm *Machine) DedupeOrigin() {
+	vm.Record("DedupeOrigin")
+	if len(vm.Positions) == 0 {
+		return
+	}
+
+	origin := vm.Positions[0].Vector()
+	idx := 1
+	for idx < len(vm.Positions) {
+		pos := vm.Positions[idx]
+		if pos.Vector() != origin {
+			break
+		}
+		if pos.State.MoveMode != MoveModeNone && pos.State.MoveMode != MoveModeRapid && pos.State.MoveMode != MoveModeLinear {
+			break
+		}
+		idx++
+	}
+
+	remap := make([]int, len(vm.Positions))
+	for i := range remap {
+		if i >= idx {
+			remap[i] = i - idx + 1
+		} else if i > 0 {
+			remap[i] = 1
+		}
+	}
+
+	vm.Positions = append(vm.Positions[:1], vm.Positions[idx:]...)
+	vm.RemapDiagnostics(remap)
+}
+
+// Append the positions of another machine
+func (vm *Machine) Append(o *Machine) {
+	vm.Record("Append", len(o.Positions))
+	offset := len(vm.Positions)
+	vm.Positions = append(vm.Positions, o.Positions...)
+	for _, a := range o.Arcs {
+		a.Index += offset
+		a.End += offset
+		vm.Arcs = append(vm.Arcs, a)
+	}
+	for _, idx := range o.redundantToolChanges {
+		vm.redundantToolChanges = append(vm.redundantToolChanges, idx+offset)
 	}
-	return eta
 }
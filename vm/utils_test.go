@@ -0,0 +1,817 @@
+package vm
+
+import "math"
+import "testing"
+import "time"
+import "github.com/kennylevinsen/gocnc/gcode"
+import "github.com/kennylevinsen/gocnc/vector"
+
+func TestNormalizeFeedUnits(t *testing.T) {
+	m := process(t, "G21G90G94\nG1F100X10\nG93\nG1X20F6\nG94\nG1X30F200\n")
+	m.NormalizeFeedUnits()
+	expected := []float64{100, 60, 200}
+	for idx, pos := range m.Positions[1:] {
+		if pos.State.FeedMode != FeedModeUnitsMin {
+			t.Errorf("position %d: feed mode not normalized", idx+1)
+		}
+		if math.Abs(pos.State.Feedrate-expected[idx]) > 1e-9 {
+			t.Errorf("position %d: expected feedrate %f, got %f", idx+1, expected[idx], pos.State.Feedrate)
+		}
+	}
+}
+
+func TestCuttingOnly(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG0X0Y0\nG1Z-1F100\nG1X10\nG0Z5\nG0X20\nG1Z-1\nG1X30\nG0Z5\n")
+	m.Tools = ToolTable{1: {Diameter: 6}}
+	n := m.CuttingOnly()
+
+	var cuts []float64
+	for _, pos := range n.Positions {
+		switch pos.State.MoveMode {
+		case MoveModeRapid:
+			t.Errorf("rapid move kept at %v", pos.Vector())
+		case MoveModeLinear:
+			cuts = append(cuts, pos.X)
+		}
+	}
+	expected := []float64{0, 10, 20, 30}
+	if len(cuts) != len(expected) {
+		t.Fatalf("expected %d cutting moves, got %d", len(expected), len(cuts))
+	}
+	for idx := range cuts {
+		if cuts[idx] != expected[idx] {
+			t.Errorf("cut %d: expected X%f, got X%f", idx, expected[idx], cuts[idx])
+		}
+	}
+	if len(n.Positions) != 6 {
+		t.Errorf("expected separate cuts to be split by gaps, got %d positions", len(n.Positions))
+	}
+
+	n.Tools[1] = Tool{Diameter: 3}
+	if m.Tools[1].Diameter != 6 {
+		t.Errorf("tool table of the original was modified through the copy")
+	}
+}
+
+func TestRemapDiagnosticsBacklash(t *testing.T) {
+	m := process(t, "G21G90\nT1M6\nG1F100X10Y0\nX20\nT1M6\nX10\nG3X0Y10I-10J0\n")
+	before := m.Arcs[0]
+	m.AddBacklashComp(0.1, 0, 0)
+	if len(m.Arcs) != 1 {
+		t.Fatalf("expected the arc to be kept, got %d arcs", len(m.Arcs))
+	}
+	a := m.Arcs[0]
+	if a.Index != before.Index+1 || a.End != before.End+1 {
+		t.Errorf("expected arc at %d-%d, got %d-%d", before.Index+1, before.End+1, a.Index, a.End)
+	}
+	end := m.Positions[a.End]
+	if math.Abs(end.X+0.1) > 1e-9 || math.Abs(end.Y-10) > 1e-9 {
+		t.Errorf("arc end does not point at the compensated end point: %v", end.Vector())
+	}
+
+	c := m.CheckRedundantToolChange()
+	if len(c) != 1 {
+		t.Fatalf("expected 1 redundant tool change, got %v", c)
+	}
+	if p := m.Positions[c[0]]; math.Abs(p.X-9.9) > 1e-9 {
+		t.Errorf("expected the change before the compensated X10, got %v", p.Vector())
+	}
+}
+
+func TestReprojectArcs(t *testing.T) {
+	m := process(t, "G21G90G18\nG1F100X10Y5Z0\nG3X0Z10I-10K0\n")
+	clockwise := m.Arcs[0].Clockwise
+	if err := m.ReprojectArcs(PlaneXZ, PlaneYZ); err != nil {
+		t.Fatal(err)
+	}
+	a := m.Arcs[0]
+	if a.Plane != PlaneYZ || a.Clockwise == clockwise {
+		t.Errorf("arc not reprojected: %+v", a)
+	}
+	for idx := a.Index; idx <= a.End; idx++ {
+		pos := m.Positions[idx]
+		if math.Abs(pos.X-5) > 1e-9 || math.Abs(math.Hypot(pos.Y, pos.Z)-10) > 1e-9 {
+			t.Errorf("position %d is off the reprojected arc: %v", idx, pos.Vector())
+		}
+	}
+	if end := m.Positions[a.End]; math.Abs(end.Y) > 1e-9 || math.Abs(end.Z-10) > 1e-9 {
+		t.Errorf("unexpected arc end: %v", end.Vector())
+	}
+
+	helix := process(t, "G21G90G18\nG1F100X10Y5Z0\nG3X0Y6Z10I-10K0\n")
+	if err := helix.ReprojectArcs(PlaneXZ, PlaneYZ); err == nil {
+		t.Errorf("expected a helical arc to be rejected")
+	}
+}
+
+func TestChipThinningFeed(t *testing.T) {
+	doc, err := gcode.Parse("G21G90M3S1000\nG1F500X10Y0Z-1\nG3X0Y10I-10J0\nG1X0Y11\nG2X11Y0I0J-11\nG1X20\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Machine
+	m.Init()
+	m.ArcSegmentsOverride = 16
+	if err := m.Process(doc); err != nil {
+		t.Fatal(err)
+	}
+	m.ChipThinningFeed(3, 0.1)
+
+	inner, outer := m.Arcs[0], m.Arcs[1]
+	for idx := inner.Index + 1; idx < inner.End; idx++ {
+		if f := m.Positions[idx].State.Feedrate; math.Abs(f-100) > 1e-9 {
+			t.Errorf("position %d: expected slotting feed of 100, got %f", idx, f)
+		}
+	}
+	for idx := outer.Index + 1; idx < outer.End; idx++ {
+		if f := m.Positions[idx].State.Feedrate; f <= 100+1e-9 || f > 150 {
+			t.Errorf("position %d: expected feed raised for chip thinning, got %f", idx, f)
+		}
+	}
+	for idx, pos := range m.Positions {
+		if idx > 0 && (idx < inner.Index || (idx > inner.End && idx < outer.Index) || idx > outer.End) && pos.State.Feedrate != 500 {
+			t.Errorf("position %d: straight move changed to %f", idx, pos.State.Feedrate)
+		}
+	}
+}
+
+func TestClampFeedrate(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG1F5X10\nG1F10000X20\nG1F500X30\n")
+	m.ClampFeedrate(50, 3000)
+	expected := []float64{50, 3000, 500}
+	for idx, pos := range m.Positions[2:] {
+		if pos.State.Feedrate != expected[idx] {
+			t.Errorf("position %d: expected feedrate %f, got %f", idx+2, expected[idx], pos.State.Feedrate)
+		}
+	}
+	if f := m.Positions[1].State.Feedrate; f != 0 {
+		t.Errorf("expected the rapid to be left alone, got feedrate %f", f)
+	}
+}
+
+func TestStateAt(t *testing.T) {
+	m := process(t, "G21G90\nT1M6\nM3S1000\nG1F100X10\nT2M6\nM5\nG1X20\n")
+	s, err := m.StateAt(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.SpindleEnabled || s.SpindleSpeed != 1000 || s.ToolIndex != 1 {
+		t.Errorf("unexpected state at 1: %+v", s)
+	}
+	s, err = m.StateAt(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.SpindleEnabled || s.ToolIndex != 2 {
+		t.Errorf("unexpected state at 2: %+v", s)
+	}
+	if tool := m.ActiveTool(1); tool != 1 {
+		t.Errorf("expected tool 1, got %d", tool)
+	}
+	if _, err := m.StateAt(len(m.Positions)); err == nil {
+		t.Error("expected an error for an index out of range")
+	}
+	if tool := m.ActiveTool(-1); tool != -1 {
+		t.Errorf("expected -1 out of range, got %d", tool)
+	}
+}
+
+func TestDetectSafetyHeight(t *testing.T) {
+	src := "G21G90\nG0Z5\nX10\nG1F100Z-1\nX20\nG0Z5\nX30\nG1Z-1\nX40\nG0Z50\nX50\nG1Z-1\nX60\nG0Z5\n"
+	m := process(t, src)
+	expected := map[SafetyStrategy]float64{
+		SafetyMaxZ:               50,
+		SafetyMostCommonRetractZ: 5,
+		SafetyFirstRapidZ:        5,
+	}
+	for strategy, height := range expected {
+		h, err := m.DetectSafetyHeight(strategy)
+		if err != nil {
+			t.Errorf("strategy %d: %s", strategy, err)
+		} else if h != height {
+			t.Errorf("strategy %d: expected %f, got %f", strategy, height, h)
+		}
+	}
+
+	m = process(t, "G21G90\nG1F100X10\n")
+	if _, err := m.DetectSafetyHeight(SafetyMostCommonRetractZ); err == nil {
+		t.Error("expected an error without retracts")
+	}
+}
+
+func TestAddBacklashComp(t *testing.T) {
+	m := process(t, "G21G90\nG1F100X10Y5\nX20\nX15\nY10\n")
+	m.AddBacklashComp(0.1, 0.2, 0)
+	expected := [][2]float64{{0, 0}, {10, 5}, {20, 5}, {19.9, 5}, {14.9, 5}, {14.9, 10}}
+	if len(m.Positions) != len(expected) {
+		t.Fatalf("expected %d positions, got %d", len(expected), len(m.Positions))
+	}
+	for idx, e := range expected {
+		pos := m.Positions[idx]
+		if math.Abs(pos.X-e[0]) > 1e-9 || math.Abs(pos.Y-e[1]) > 1e-9 {
+			t.Errorf("position %d: expected X%v Y%v, got %v", idx, e[0], e[1], pos.Vector())
+		}
+	}
+}
+
+func TestETABreakdown(t *testing.T) {
+	m := process(t, "G21G90\nT1M6\nG0X10Z5\nG1F600Z-1\nX70\nG4P2\nT2M6\nG0Z5\n")
+	cutting, rapid, dwell, toolChange := m.ETABreakdown()
+	for name, d := range map[string]time.Duration{"cutting": cutting, "rapid": rapid, "dwell": dwell, "tool change": toolChange} {
+		if d <= 0 {
+			t.Errorf("expected some %s time, got %s", name, d)
+		}
+	}
+	if dwell != 2*time.Second {
+		t.Errorf("expected 2s of dwell, got %s", dwell)
+	}
+	if sum := cutting + rapid + dwell + toolChange; sum != m.ETA() {
+		t.Errorf("expected the components to sum to %s, got %s", m.ETA(), sum)
+	}
+}
+
+func TestStripPreamble(t *testing.T) {
+	src := "G17G21G90G54\nM3S1000\nG0X0Y0Z5\nG1F100Z-1\nX10\nG0Z5\n"
+	markers := func(m *Machine) int {
+		n := 0
+		for _, pos := range m.Positions {
+			if pos.State.MoveMode == MoveModeNone {
+				n++
+			}
+		}
+		return n
+	}
+
+	m, o := process(t, src), process(t, src)
+	before, moves := markers(m), len(o.Positions)-markers(o)
+	o.StripPreamble()
+	if o.Positions[0].State.MoveMode != MoveModeRapid {
+		t.Errorf("expected the program to start with the first move, got mode %d", o.Positions[0].State.MoveMode)
+	}
+	m.Append(o)
+	if n := markers(m); n != before {
+		t.Errorf("expected %d state markers, got %d", before, n)
+	}
+	if n := len(m.Positions) - markers(m); n != 2*moves {
+		t.Errorf("expected %d moves, got %d", 2*moves, n)
+	}
+	if s := m.Positions[len(m.Positions)-1].State; !s.SpindleEnabled || s.SpindleSpeed != 1000 {
+		t.Errorf("expected the appended moves to keep their state, got %+v", s)
+	}
+}
+
+func TestScaleLaserPower(t *testing.T) {
+	src := "G21G90\nM3S1000\nG1F1000X10\nF200Y10\nF2000X0\n"
+	m := processWith(t, src, func(m *Machine) {
+		m.LaserMode = true
+	})
+	m.ScaleLaserPower(0.5)
+	expected := []float64{500, 100, 1000}
+	for idx, pos := range m.Positions[1:4] {
+		if pos.State.SpindleSpeed != expected[idx] {
+			t.Errorf("position %d: expected power %f, got %f", idx+1, expected[idx], pos.State.SpindleSpeed)
+		}
+	}
+
+	// Outside laser mode, S is left alone
+	m = process(t, src)
+	m.ScaleLaserPower(0.5)
+	if s := m.Positions[2].State.SpindleSpeed; s != 1000 {
+		t.Errorf("expected speed 1000, got %f", s)
+	}
+}
+
+func TestETAArc(t *testing.T) {
+	m := process(t, "G21G90\nT1M6\nG1F60X10Y0\nG3X0Y10I-10J0\n")
+	line := process(t, "G21G90\nT1M6\nG1F60X10Y0\n")
+	arc := (m.ETA() - line.ETA()).Seconds()
+
+	// A quarter circle of radius 10 at 1 mm/s
+	if expected := math.Pi * 10 / 2; math.Abs(arc-expected) > 0.01 {
+		t.Errorf("expected the arc to take %fs, got %fs", expected, arc)
+	}
+}
+
+func TestInvertZ(t *testing.T) {
+	// Positive-down program, cutting at Z10
+	src := "G21G90\nG0Z-5\nG1F100Z10\nX10\nG18\nG2X20Z10I5K0\nG0Z-5\n"
+	m := process(t, src)
+	m.InvertZ()
+	cuts := 0
+	for _, pos := range m.Positions {
+		if pos.State.MoveMode == MoveModeLinear && pos.Z < 0 {
+			cuts++
+		}
+	}
+	if cuts == 0 || len(m.Operations()) != 1 {
+		t.Errorf("expected one operation below zero, got %d cuts in %d operations", cuts, len(m.Operations()))
+	}
+	if m.Arcs[0].Clockwise {
+		t.Errorf("expected the XZ arc to change direction")
+	}
+
+	m.InvertZ()
+	orig := process(t, src)
+	for idx, pos := range orig.Positions {
+		if m.Positions[idx] != pos {
+			t.Errorf("position %d: expected %v, got %v", idx, pos.Vector(), m.Positions[idx].Vector())
+		}
+	}
+	if m.Arcs[0] != orig.Arcs[0] || m.StockTop != orig.StockTop {
+		t.Errorf("expected the arcs and stock top to be restored")
+	}
+}
+
+func TestInsertDirectionDwell(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG1F100Z-1\nX10\nX0\nG2X-10Y10I0J10\n")
+	m.InsertDirectionDwell(90, 0.5)
+	var dwells []Position
+	for _, pos := range m.Positions {
+		if pos.State.MoveMode == MoveModeDwell {
+			dwells = append(dwells, pos)
+		}
+	}
+	if len(dwells) != 1 {
+		t.Fatalf("expected one dwell, got %d", len(dwells))
+	}
+	if d := dwells[0]; d.X != 10 || d.State.DwellTime != 0.5 {
+		t.Errorf("expected a 0.5s dwell at X10, got %fs at %v", d.State.DwellTime, d.Vector())
+	}
+}
+
+func TestScaleToTargetTime(t *testing.T) {
+	src := "G21G90\nT1M6\nG1F600X100\nY100\n"
+	m := process(t, src)
+	target := m.ETA() - 10*time.Second
+	multiplier, err := m.ScaleToTargetTime(target, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := m.ETA() - target; diff > 10*time.Millisecond || diff < -10*time.Millisecond {
+		t.Errorf("expected an ETA of %s, got %s", target, m.ETA())
+	}
+	if math.Abs(multiplier-2) > 0.01 {
+		t.Errorf("expected a multiplier of 2, got %f", multiplier)
+	}
+
+	// Capped feedrates cannot reach the target
+	m = process(t, src)
+	if _, err := m.ScaleToTargetTime(target, 900); err == nil {
+		t.Errorf("expected the target to be unreachable at 900 mm/min, got an ETA of %s", m.ETA())
+	}
+}
+
+func TestFeedByDepth(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG1F100Z-1\nX10\nZ-2\nX0\nZ-5\nX10\nZ-8\nX0\n")
+	m.FeedByDepth([]DepthFeed{{MaxDepth: 5, Feed: 300}, {MaxDepth: 1, Feed: 1000}, {MaxDepth: 2, Feed: 600}})
+	expected := map[float64]float64{-1: 1000, -2: 600, -5: 300, -8: 100}
+	for idx, pos := range m.Positions {
+		if f, ok := expected[pos.Z]; ok && pos.State.Feedrate != f {
+			t.Errorf("position %d at Z%v: expected feedrate %f, got %f", idx, pos.Z, f, pos.State.Feedrate)
+		}
+	}
+	if f := m.Positions[1].State.Feedrate; f != 0 {
+		t.Errorf("expected the rapid to be left alone, got feedrate %f", f)
+	}
+}
+
+func TestRoundCorners(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG1F100Z-1\nX10\nY10\nG0Z5\n")
+	if err := m.RoundCorners(2); err != nil {
+		t.Fatal(err)
+	}
+
+	var fillet []Position
+	for _, pos := range m.Positions {
+		if pos.X == 10 && pos.Y == 0 {
+			t.Errorf("expected the corner to be removed")
+		}
+		if pos.Z == -1 && pos.X >= 8-1e-9 && pos.Y <= 2+1e-9 {
+			fillet = append(fillet, pos)
+		}
+	}
+	if len(fillet) < 3 {
+		t.Fatalf("expected a linearized fillet, got %d points", len(fillet))
+	}
+	first, last := fillet[0], fillet[len(fillet)-1]
+	if math.Abs(first.X-8) > 1e-9 || math.Abs(first.Y) > 1e-9 || math.Abs(last.X-10) > 1e-9 || math.Abs(last.Y-2) > 1e-9 {
+		t.Errorf("expected the fillet from X8Y0 to X10Y2, got %v to %v", first.Vector(), last.Vector())
+	}
+	for _, pos := range fillet {
+		if r := math.Hypot(pos.X-8, pos.Y-2); math.Abs(r-2) > 1e-9 {
+			t.Errorf("fillet point %v is %f from the center", pos.Vector(), r)
+		}
+	}
+	for idx := 1; idx < len(fillet); idx++ {
+		a, b := fillet[idx-1], fillet[idx]
+		mid := math.Hypot((a.X+b.X)/2-8, (a.Y+b.Y)/2-2)
+		if 2-mid > m.MaxArcDeviation+1e-9 {
+			t.Errorf("fillet segment deviates by %f", 2-mid)
+		}
+	}
+
+	if err := m.RoundCorners(0); err == nil {
+		t.Error("expected an error for a zero radius")
+	}
+}
+
+func TestRoundCornersDiagnostics(t *testing.T) {
+	m := process(t, "G21G90\nT1M6\nG0Z5\nG1F100Z-1\nG2X10Y0Z-2I5J0\nG1X20\nY10\nT1M6\nX0\nG0Z5\n")
+	before := m.Arcs[0]
+	if err := m.RoundCorners(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The helical arc has no corners at constant Z, and precedes the rounded ones
+	if len(m.Arcs) != 1 {
+		t.Fatalf("expected the arc to be kept, got %d arcs", len(m.Arcs))
+	}
+	if a := m.Arcs[0]; a.Index != before.Index || a.End != before.End {
+		t.Errorf("expected arc at %d-%d, got %d-%d", before.Index, before.End, a.Index, a.End)
+	}
+
+	c := m.CheckRedundantToolChange()
+	if len(c) != 1 {
+		t.Fatalf("expected 1 redundant tool change, got %v", c)
+	}
+	if p := m.Positions[c[0]]; p.X != 0 || p.Y != 10 {
+		t.Errorf("expected the change before the cut to X0, got %v", p.Vector())
+	}
+}
+
+func TestShear(t *testing.T) {
+	m := process(t, "G21G90\nG1F100X10\nY10\nX0\nY0\n")
+	m.Shear(0.1, 0.2)
+	expected := [][2]float64{{0, 0}, {10, 2}, {11, 12}, {1, 10}, {0, 0}}
+	for idx, e := range expected {
+		pos := m.Positions[idx]
+		if math.Abs(pos.X-e[0]) > 1e-9 || math.Abs(pos.Y-e[1]) > 1e-9 {
+			t.Errorf("corner %d: expected X%v Y%v, got %v", idx, e[0], e[1], pos.Vector())
+		}
+	}
+}
+
+func TestDedupeOrigin(t *testing.T) {
+	m := process(t, "G21G90\nG0X0Y0Z0\nG1F100X0\nX10\n")
+	n := len(m.Positions)
+	m.DedupeOrigin()
+	if len(m.Positions) != n-2 {
+		t.Fatalf("expected %d positions, got %d", n-2, len(m.Positions))
+	}
+	if p := m.Positions[0]; p.Vector() != (vector.Vector{}) {
+		t.Errorf("expected the origin to be kept, got %v", p.Vector())
+	}
+	if p := m.Positions[1]; p.X != 10 || p.State.MoveMode != MoveModeLinear {
+		t.Errorf("expected the cut to X10 to follow the origin, got %v", p.Vector())
+	}
+}
+
+func TestDedupeOriginDiagnostics(t *testing.T) {
+	m := process(t, "G21G90\nT1M6\nG0X0Y0Z0\nT1M6\nG1F100X0\nX5\nG2X15Y0I5J0\n")
+	before := m.Arcs[0]
+	n := len(m.Positions)
+	m.DedupeOrigin()
+	shift := n - len(m.Positions)
+
+	if len(m.Arcs) != 1 {
+		t.Fatalf("expected the arc to be kept, got %d arcs", len(m.Arcs))
+	}
+	if a := m.Arcs[0]; a.Index != before.Index-shift || a.End != before.End-shift {
+		t.Errorf("expected arc at %d-%d, got %d-%d", before.Index-shift, before.End-shift, a.Index, a.End)
+	}
+
+	// The change was before a removed move, so it moves to the cut after it
+	c := m.CheckRedundantToolChange()
+	if len(c) != 1 {
+		t.Fatalf("expected 1 redundant tool change, got %v", c)
+	}
+	if p := m.Positions[c[0]]; p.X != 5 {
+		t.Errorf("expected the change before the cut to X5, got %v", p.Vector())
+	}
+}
+
+func TestLimitArcFeed(t *testing.T) {
+	minFeed := func(src string) float64 {
+		m := process(t, src)
+		m.LimitArcFeed(500)
+		f := math.Inf(1)
+		for _, pos := range m.Positions[m.Arcs[0].Index+1 : m.Arcs[0].End] {
+			f = math.Min(f, pos.State.Feedrate)
+		}
+		return f
+	}
+
+	tight := minFeed("G21G90\nG1F3000X2Y0\nG3X0Y2I-2J0\n")
+	if expected := math.Sqrt(500*2) * 60; math.Abs(tight-expected) > 1 {
+		t.Errorf("expected the tight arc at %f, got %f", expected, tight)
+	}
+	if gentle := minFeed("G21G90\nG1F3000X50Y0\nG3X0Y50I-50J0\n"); gentle != 3000 {
+		t.Errorf("expected the gentle arc to keep its feedrate, got %f", gentle)
+	}
+}
+
+func TestOptimalSafetyHeight(t *testing.T) {
+	m := process(t, "G21G90\nG0Z25\nG1F100Z-2\nX10\nZ-1\nX20\nZ1\nX30\nZ-2\nG0Z25\n")
+	h := m.OptimalSafetyHeight(3)
+	if h != 2 {
+		t.Errorf("expected the tallest cut plus clearance of 2, got %f", h)
+	}
+	if err := m.SetSafetyHeight(h); err != nil {
+		t.Fatal(err)
+	}
+	if s := m.FindSafetyHeight(); s != 2 {
+		t.Errorf("expected a safety height of 2, got %f", s)
+	}
+
+	m = process(t, "G21G90\nG0Z25\nG1F100Z5\nX10\nG0Z25\n")
+	if h := m.OptimalSafetyHeight(3); h != 3 {
+		t.Errorf("expected feed moves above the stock to be ignored, got %f", h)
+	}
+}
+
+func TestSetRetractFeed(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG1F100Z-1\nX10\nG0Z5\nX0\n")
+	m.SetRetractFeed(300)
+	found := false
+	for idx := 1; idx < len(m.Positions); idx++ {
+		last, pos := m.Positions[idx-1], m.Positions[idx]
+		if pos.State.MoveMode == MoveModeNone {
+			continue
+		}
+		if pos.X == last.X && pos.Y == last.Y && pos.Z > last.Z {
+			found = true
+			if pos.State.MoveMode != MoveModeLinear || pos.State.Feedrate != 300 {
+				t.Errorf("position %d: expected a linear retract at F300, got %+v", idx, pos.State)
+			}
+		} else if pos.X != last.X && pos.Z == 5 && pos.State.MoveMode != MoveModeRapid {
+			t.Errorf("position %d: expected the travel to stay rapid", idx)
+		}
+	}
+	if !found {
+		t.Fatal("no retract found")
+	}
+}
+
+func TestAddTabs(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG0X0Y0\nG1F100Z-2\nX10\nY10\nX0\nY0\nG0Z5\n"+
+		"G0X20Y0\nG1Z-2\nX30\nY10\nX20\nY0\nG0Z5\n")
+	if err := m.AddTabs(3, -0.5, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Count the raised runs of each contour, and check their length
+	var (
+		tabs   []int
+		run    float64
+		raised bool
+	)
+	for idx := 1; idx < len(m.Positions); idx++ {
+		a, b := m.Positions[idx-1], m.Positions[idx]
+		if b.Z > 0 {
+			raised = false
+			continue
+		}
+		if a.Z > 0 {
+			tabs = append(tabs, 0)
+			continue
+		}
+		if a.Z == -0.5 && b.Z == -0.5 {
+			if !raised {
+				tabs[len(tabs)-1]++
+				run = 0
+			}
+			raised = true
+			run += math.Hypot(b.X-a.X, b.Y-a.Y)
+			continue
+		}
+		if raised && math.Abs(run-2) > 1e-9 {
+			t.Errorf("expected a tab width of 2, got %f", run)
+		}
+		raised = false
+	}
+	if len(tabs) != 2 || tabs[0] != 3 || tabs[1] != 3 {
+		t.Errorf("expected 3 tabs on each of 2 contours, got %v", tabs)
+	}
+
+	if err := m.AddTabs(0, -0.5, 2); err == nil {
+		t.Error("expected an error for a tab count of 0")
+	}
+}
+
+func TestAddTabsDiagnostics(t *testing.T) {
+	m := process(t, "G21G90\nT1M6\nG0Z5\nG0X0Y0\nG1F100Z-2\nX10\nY10\nX0\nY0\nG0Z5\n"+
+		"T1M6\nG0X20Y0\nG1Z-2\nG2X30Y0I5J0\nG0Z5\n")
+	if err := m.AddTabs(1, -0.5, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// The open arc gets no tabs, but moves along with the tabs before it
+	if len(m.Arcs) != 1 {
+		t.Fatalf("expected the arc to be kept, got %d arcs", len(m.Arcs))
+	}
+	a := m.Arcs[0]
+	if p := m.Positions[a.Index]; math.Hypot(p.X-20, p.Y) > 1e-9 || p.Z != -2 {
+		t.Errorf("expected the arc to start at X20Y0, got %v", p.Vector())
+	}
+	if p := m.Positions[a.End]; p.X != 30 || p.Y != 0 || p.Z != -2 {
+		t.Errorf("expected the arc to end at X30Y0, got %v", p.Vector())
+	}
+
+	c := m.CheckRedundantToolChange()
+	if len(c) != 1 {
+		t.Fatalf("expected 1 redundant tool change, got %v", c)
+	}
+	if p := m.Positions[c[0]]; p.X != 20 || p.Z != 5 {
+		t.Errorf("expected the change before the travel to X20, got %v", p.Vector())
+	}
+}
+
+func TestAdaptiveFeed(t *testing.T) {
+	m := process(t, "G21G90\nG0Z1\nG1F100Z-1\nX20\nY2\nX0\n")
+	m.Tools = ToolTable{m.Positions[3].State.ToolIndex: {Diameter: 6}}
+	m.AdaptiveFeed(300, 1.5)
+
+	// The first pass is a full slot, and the second a 2 mm stepover
+	if expected := 300 * 1.5 / math.Pi; math.Abs(m.Positions[3].State.Feedrate-expected) > 1e-9 {
+		t.Errorf("expected the slot to be slowed to F%f, got F%f", expected, m.Positions[3].State.Feedrate)
+	}
+	if m.Positions[5].State.Feedrate != 300 {
+		t.Errorf("expected the light pass to run at F300, got F%f", m.Positions[5].State.Feedrate)
+	}
+	if m.Positions[2].State.Feedrate != 100 {
+		t.Errorf("expected the plunge to keep F100, got F%f", m.Positions[2].State.Feedrate)
+	}
+}
+
+func TestTrimAirMoves(t *testing.T) {
+	m := process(t, "G21G90\nG0Z5\nG0X50Y50\nG0X10Y10\nG0X20Y0\nG0Z1\nG1F100Z-1\nX30\nG0Z5\nG0X50Y50\nG0X100\n")
+	m.TrimAirMoves()
+
+	// A single approach at safety height, and the final retract
+	expected := []vector.Vector{
+		{0, 0, 5},
+		{20, 0, 5},
+		{20, 0, 1},
+		{20, 0, -1},
+		{30, 0, -1},
+		{30, 0, 5},
+	}
+	var moves []vector.Vector
+	for _, pos := range m.Positions[1:] {
+		if pos.State.MoveMode != MoveModeNone {
+			moves = append(moves, pos.Vector())
+		}
+	}
+	if len(moves) != len(expected) {
+		t.Fatalf("expected moves %v, got %v", expected, moves)
+	}
+	for idx := range expected {
+		if moves[idx] != expected[idx] {
+			t.Errorf("move %d: expected %v, got %v", idx, expected[idx], moves[idx])
+		}
+	}
+}
+
+func TestRotateXY(t *testing.T) {
+	m := process(t, "G21G90\nG0X10Y0Z-1\nG2X0Y-10I-10J0F100\n")
+	m.RotateXY(90, 5, 5)
+
+	// The arc around X0 Y0 is now centered at X10 Y0
+	for _, arc := range m.Arcs {
+		for idx := arc.Index; idx <= arc.End; idx++ {
+			pos := m.Positions[idx]
+			if r := math.Hypot(pos.X-10, pos.Y); math.Abs(r-10) > 1e-9 {
+				t.Errorf("position %d: expected a radius of 10, got %f", idx, r)
+			}
+			if pos.Z != -1 {
+				t.Errorf("position %d: expected Z to be untouched, got %f", idx, pos.Z)
+			}
+		}
+	}
+	if end := m.Positions[len(m.Positions)-1]; math.Abs(end.X-20) > 1e-9 || math.Abs(end.Y) > 1e-9 {
+		t.Errorf("expected the arc to end at X20 Y0, got X%f Y%f", end.X, end.Y)
+	}
+}
+
+func TestInsertSpindleReversalDwell(t *testing.T) {
+	m := process(t, "G21G90\nM3S1000\nG1F100X10\nM4\nG1X20\nM5\nG1X30\nM3\nG1X40\n")
+	m.InsertSpindleReversalDwell(2)
+	var dwells []float64
+	for _, pos := range m.Positions {
+		if pos.State.MoveMode == MoveModeDwell {
+			dwells = append(dwells, pos.X)
+		}
+	}
+	if len(dwells) != 1 || dwells[0] != 10 {
+		t.Errorf("expected a single dwell at X10, got %v", dwells)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	src := "G21G90\nM3S1000\nG0X2Y1Z5\nG1F100Z-1\nX10\nY6\nX2\nY1\nG0Z5\n"
+	m := process(t, src)
+	m.MirrorX(true)
+	minx, miny, _, maxx, maxy, _, _ := m.Info()
+	if minx != -10 || maxx != 0 || miny != 0 || maxy != 6 {
+		t.Errorf("unexpected bounds after MirrorX: X%v..%v Y%v..%v", minx, maxx, miny, maxy)
+	}
+	for idx, pos := range m.Positions {
+		if pos.State.SpindleEnabled && pos.State.SpindleClockwise {
+			t.Errorf("position %d: expected the spindle to be reversed", idx)
+		}
+	}
+
+	m = process(t, src)
+	m.MirrorY(false)
+	minx, miny, _, maxx, maxy, _, _ = m.Info()
+	if minx != 0 || maxx != 10 || miny != -6 || maxy != 0 {
+		t.Errorf("unexpected bounds after MirrorY: X%v..%v Y%v..%v", minx, maxx, miny, maxy)
+	}
+	for idx, pos := range m.Positions {
+		if pos.State.SpindleEnabled && !pos.State.SpindleClockwise {
+			t.Errorf("position %d: expected the spindle direction to be kept", idx)
+		}
+	}
+}
+
+func TestSmoothFeedByAccel(t *testing.T) {
+	// Going from 10 to 100 mm/s over 1 mm moves at 1000 mm/s^2 takes 4 moves
+	m := process(t, "G21G90\nG0Z1\nG1F600Z-1\nX1\nF6000\nX2\nX3\nX4\nX5\nX6\nX7\nX8\nG0Z1\n")
+	m.SmoothFeedByAccel(1000)
+	expected := []float64{600, 600, math.Sqrt(2100) * 60, math.Sqrt(4100) * 60, math.Sqrt(6100) * 60, 5400, 6000, 6000, 6000}
+	for idx, feed := range expected {
+		if pos := m.Positions[idx+2]; math.Abs(pos.State.Feedrate-feed) > 1e-9 {
+			t.Errorf("X%v: expected F%f, got F%f", pos.X, feed, pos.State.Feedrate)
+		}
+	}
+}
+
+func TestInsertDirectionDwellDiagnostics(t *testing.T) {
+	m := process(t, "G21G90\nT1M6\nG0Z5\nG1F100Z-1\nX10\nT1M6\nX0\nG2X-10Y10I0J10\n")
+	before := m.Arcs[0]
+	m.InsertDirectionDwell(90, 0.5)
+	if len(m.Arcs) != 1 {
+		t.Fatalf("expected the arc to be kept, got %d arcs", len(m.Arcs))
+	}
+	if a := m.Arcs[0]; a.Index != before.Index+1 || a.End != before.End+1 {
+		t.Errorf("expected arc at %d-%d, got %d-%d", before.Index+1, before.End+1, a.Index, a.End)
+	}
+
+	c := m.CheckRedundantToolChange()
+	if len(c) != 1 {
+		t.Fatalf("expected 1 redundant tool change, got %v", c)
+	}
+	if p := m.Positions[c[0]]; p.X != 0 || p.State.MoveMode != MoveModeLinear {
+		t.Errorf("expected the change before X0, got %v", p.Vector())
+	}
+}
+
+func TestStripPreambleAppendDiagnostics(t *testing.T) {
+	src := "G21G90\nT1M6\nG0X0Y0Z5\nG1F100Z-1\nT1M6\nX10\nG3X0Y10I-10J0\nG0Z5\n"
+	m, o := process(t, src), process(t, src)
+	o.StripPreamble()
+	m.Append(o)
+
+	if len(m.Arcs) != 2 {
+		t.Fatalf("expected 2 arcs, got %d", len(m.Arcs))
+	}
+	for idx, a := range m.Arcs {
+		start, end := m.Positions[a.Index], m.Positions[a.End]
+		if math.Hypot(start.X-10, start.Y) > 1e-9 || math.Hypot(end.X, end.Y-10) > 1e-9 {
+			t.Errorf("arc %d does not point at its end points: %v, %v", idx, start.Vector(), end.Vector())
+		}
+	}
+
+	c := m.CheckRedundantToolChange()
+	if len(c) != 2 {
+		t.Fatalf("expected 2 redundant tool changes, got %v", c)
+	}
+	for idx := range c {
+		if p := m.Positions[c[idx]]; p.X != 10 || p.Z != -1 {
+			t.Errorf("change %d: expected the change before X10, got %v", idx, p.Vector())
+		}
+	}
+}
+
+func TestTrimAirMovesDiagnostics(t *testing.T) {
+	m := process(t, "G21G90\nT1M6\nG0Z5\nG0X50Y50\nT1M6\nG0X20Y0\nG0Z1\nG1F100Z-1\nG2X30Y10I10J0\nG0Z5\nG0X50Y50\n")
+	m.TrimAirMoves()
+	if len(m.Arcs) != 1 {
+		t.Fatalf("expected the arc to be kept, got %d arcs", len(m.Arcs))
+	}
+	a := m.Arcs[0]
+	if p := m.Positions[a.Index]; math.Hypot(p.X-20, p.Y) > 1e-9 || p.Z != -1 {
+		t.Errorf("expected the arc to start at the plunge, got %v", p.Vector())
+	}
+	if p := m.Positions[a.End]; p.X != 30 || p.Y != 10 {
+		t.Errorf("expected the arc to end at X30Y10, got %v", p.Vector())
+	}
+
+	c := m.CheckRedundantToolChange()
+	if len(c) != 1 {
+		t.Fatalf("expected 1 redundant tool change, got %v", c)
+	}
+	if p := m.Positions[c[0]]; p.Z != 5 || p.X != 0 || p.Y != 0 {
+		t.Errorf("expected the change before the approach, got %v", p.Vector())
+	}
+}